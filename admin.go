@@ -0,0 +1,58 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// adminChat is notified about problems which need the attention of the operator, if set.
+var adminChat types.JID
+
+// authAlarm tells the admin about an API key which is no longer accepted.
+// A single failure may be a glitch, so only consecutive failures count.
+var authAlarm struct {
+	sync.Mutex
+	failures   int
+	lastNotice time.Time
+}
+
+// recordAuthResult counts the authentication failures of the backend and notifies the admin once there are enough.
+// Any successful transcription resets the count.
+func recordAuthResult(err error) {
+	if adminChat.IsEmpty() {
+		return
+	}
+	authAlarm.Lock()
+	defer authAlarm.Unlock()
+	if err == nil {
+		authAlarm.failures = 0
+		return
+	}
+	if !errors.Is(err, ErrAuth) {
+		return
+	}
+	authAlarm.failures++
+	if authAlarm.failures < *adminAuthFailures || time.Since(authAlarm.lastNotice) < *adminNoticeCooldown {
+		return
+	}
+	authAlarm.lastNotice = time.Now()
+	log.Warnf("Transcription failed %d times in a row due to authentication, notifying the admin.", authAlarm.failures)
+	go notifyAdmin(*adminAuthMessage)
+}
+
+func notifyAdmin(text string) {
+	err := sendMessage(context.Background(), adminChat, &waProto.Message{Conversation: proto.String(text)})
+	if err != nil {
+		log.Warnf("Failed to notify the admin: %v", err)
+	}
+}
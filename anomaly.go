@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// volumeSmoothing is the weight of the most recent hour in the moving average.
+	volumeSmoothing = 0.2
+	// volumeWarmup is the number of hours to observe before alerting.
+	volumeWarmup = 3
+)
+
+// volumeMonitor tracks the hourly number of transcriptions and seconds of audio transcribed
+// (which is what the backends charge for). In case the current hour exceeds the
+// exponentially weighted moving average of the previous hours by factor, alert is called
+// once per metric and hour.
+type volumeMonitor struct {
+	mu      sync.Mutex
+	factor  float64
+	alert   func(metric string, value, average float64)
+	hour    time.Time
+	hours   int
+	current map[string]float64
+	average map[string]float64
+	alerted map[string]bool
+}
+
+func newVolumeMonitor(factor float64, alert func(metric string, value, average float64)) *volumeMonitor {
+	return &volumeMonitor{
+		factor:  factor,
+		alert:   alert,
+		current: make(map[string]float64),
+		average: make(map[string]float64),
+		alerted: make(map[string]bool),
+	}
+}
+
+// Record counts a transcription of the given duration.
+func (m *volumeMonitor) Record(now time.Time, seconds uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roll(now.Truncate(time.Hour))
+	m.current["transcriptions"]++
+	m.current["audio_seconds"] += float64(seconds)
+	for metric, value := range m.current {
+		average := m.average[metric]
+		if m.hours >= volumeWarmup && average > 0 && value > m.factor*average && !m.alerted[metric] {
+			m.alerted[metric] = true
+			go m.alert(metric, value, average)
+		}
+	}
+}
+
+// roll folds the finished hours into the averages. Hours without any transcription count as zero.
+func (m *volumeMonitor) roll(hour time.Time) {
+	if m.hour.IsZero() {
+		m.hour = hour
+		return
+	}
+	for i := 0; m.hour.Before(hour) && i < 24*7; i++ {
+		for _, metric := range []string{"transcriptions", "audio_seconds"} {
+			if m.hours == 0 {
+				m.average[metric] = m.current[metric]
+			} else {
+				m.average[metric] = volumeSmoothing*m.current[metric] + (1-volumeSmoothing)*m.average[metric]
+			}
+		}
+		m.hours++
+		m.current = make(map[string]float64)
+		m.alerted = make(map[string]bool)
+		m.hour = m.hour.Add(time.Hour)
+	}
+	m.hour = hour
+}
@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// apiKeyBackoff is how long a rejected key is skipped.
+const apiKeyBackoff = 10 * time.Minute
+
+// apiKey holds the transcription API keys. They can be replaced while transcriptions are running.
+// Several keys may be given as a comma separated list. They are used in turns.
+type apiKey struct {
+	mu     sync.Mutex
+	keys   []string
+	next   int
+	failed map[string]time.Time
+}
+
+func newAPIKey(key string) *apiKey {
+	k := &apiKey{failed: make(map[string]time.Time)}
+	k.Set(key)
+	return k
+}
+
+// Get returns the next key, skipping keys which were rejected recently.
+// If all keys were rejected, the next one is returned regardless.
+func (k *apiKey) Get() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) == 0 {
+		return ""
+	}
+	for range k.keys {
+		key := k.keys[k.next]
+		k.next = (k.next + 1) % len(k.keys)
+		if time.Since(k.failed[key]) > apiKeyBackoff {
+			return key
+		}
+	}
+	key := k.keys[k.next]
+	k.next = (k.next + 1) % len(k.keys)
+	return key
+}
+
+// Failed marks the key as rejected.
+func (k *apiKey) Failed(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.failed[key] = time.Now()
+}
+
+// Len returns the number of keys.
+func (k *apiKey) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return max(len(k.keys), 1)
+}
+
+// String returns the keys as given.
+func (k *apiKey) String() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return strings.Join(k.keys, ",")
+}
+
+func (k *apiKey) Set(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = splitList(key)
+	k.next = 0
+	k.failed = make(map[string]time.Time)
+}
+
+// readAPIKeyFile reads the key from the file, ignoring surrounding whitespace.
+func readAPIKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// watchAPIKeyFile reloads the key whenever the file changes.
+// The directory is watched rather than the file itself, so replacing the file is noticed, too.
+// Kubernetes updates mounted secrets by swapping the ..data symlink the file points to,
+// which only shows as an event for ..data.
+func watchAPIKeyFile(path string, key *apiKey) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case event := <-watcher.Events:
+				name := filepath.Clean(event.Name)
+				if (name != filepath.Clean(path) && filepath.Base(name) != "..data") || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				newKey, err := readAPIKeyFile(path)
+				if err != nil {
+					log.Warnf("Failed to reload API key: %v", err)
+					continue
+				}
+				// an empty file is usually seen in the middle of being rewritten
+				if newKey != "" && newKey != key.String() {
+					key.Set(newKey)
+					log.Infof("Reloaded API key from %s.", path)
+				}
+			case err := <-watcher.Errors:
+				log.Warnf("Watching %s failed: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,261 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	awsTranscribe "github.com/aws/aws-sdk-go-v2/service/transcribe"
+	transcribeTypes "github.com/aws/aws-sdk-go-v2/service/transcribe/types"
+	"github.com/aws/smithy-go"
+)
+
+// AWSTranscribeTranscriber uses Amazon Transcribe. Since Amazon Transcribe only works on files in S3,
+// the audio is uploaded to a bucket, a transcription job is started and polled until it is done.
+// The uploaded audio and the job are deleted afterwards.
+type AWSTranscribeTranscriber struct {
+	Bucket       string
+	PollInterval time.Duration
+	// Diarize has the speakers told apart, up to MaxSpeakers.
+	Diarize     bool
+	MaxSpeakers int32
+	s3          *s3.Client
+	transcribe  *awsTranscribe.Client
+}
+
+// newAWSTranscribeTranscriber loads the AWS configuration from the usual places (environment, shared config).
+// If role is not empty, the role is assumed for all requests.
+func newAWSTranscribeTranscriber(region string, bucket string, role string) (*AWSTranscribeTranscriber, error) {
+	if bucket == "" {
+		return nil, errors.New("Amazon Transcribe needs an S3 bucket")
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region), config.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	if role != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role))
+	}
+	return &AWSTranscribeTranscriber{
+		Bucket:       bucket,
+		PollInterval: 2 * time.Second,
+		s3:           s3.NewFromConfig(cfg),
+		transcribe:   awsTranscribe.NewFromConfig(cfg),
+	}, nil
+}
+
+func (t *AWSTranscribeTranscriber) Transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	jobName := fmt.Sprintf("whatsmeow-transcribe-%d-%d", time.Now().UnixNano(), rand.Uint32())
+	extension := audioExtension(audio.Data, audio.Mimetype)
+	key := jobName + "." + extension
+	mediaFormat := transcribeTypes.MediaFormat(extension)
+	if extension == "oga" {
+		mediaFormat = transcribeTypes.MediaFormatOgg
+	}
+
+	_, err := t.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(t.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(audio.Data),
+	})
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: failed to upload audio: %v", classifyAWSError(err), err)
+	}
+	defer func() {
+		// clean up even if the context has been cancelled
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := t.s3.DeleteObject(cleanupCtx, &s3.DeleteObjectInput{Bucket: aws.String(t.Bucket), Key: aws.String(key)})
+		if err != nil {
+			loggerFor(ctx).Warnf("Transcription: Failed to delete s3://%s/%s: %v", t.Bucket, key, err)
+		}
+	}()
+
+	input := &awsTranscribe.StartTranscriptionJobInput{
+		TranscriptionJobName: aws.String(jobName),
+		Media:                &transcribeTypes.Media{MediaFileUri: aws.String(fmt.Sprintf("s3://%s/%s", t.Bucket, key))},
+		MediaFormat:          mediaFormat,
+		IdentifyLanguage:     aws.Bool(true),
+	}
+	if t.Diarize {
+		input.Settings = &transcribeTypes.Settings{ShowSpeakerLabels: aws.Bool(true), MaxSpeakerLabels: aws.Int32(t.MaxSpeakers)}
+	}
+	if audio.Language != "" {
+		input.IdentifyLanguage = nil
+		input.LanguageCode = transcribeTypes.LanguageCode(audio.Language)
+	}
+	_, err = t.transcribe.StartTranscriptionJob(ctx, input)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: failed to start transcription job: %v", classifyAWSError(err), err)
+	}
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := t.transcribe.DeleteTranscriptionJob(cleanupCtx, &awsTranscribe.DeleteTranscriptionJobInput{TranscriptionJobName: aws.String(jobName)})
+		if err != nil {
+			loggerFor(ctx).Warnf("Transcription: Failed to delete transcription job %s: %v", jobName, err)
+		}
+	}()
+
+	var job *transcribeTypes.TranscriptionJob
+	for {
+		out, err := t.transcribe.GetTranscriptionJob(ctx, &awsTranscribe.GetTranscriptionJobInput{TranscriptionJobName: aws.String(jobName)})
+		if err != nil {
+			return Transcript{}, fmt.Errorf("%w: failed to get transcription job: %v", classifyAWSError(err), err)
+		}
+		job = out.TranscriptionJob
+		if job.TranscriptionJobStatus == transcribeTypes.TranscriptionJobStatusCompleted {
+			break
+		}
+		if job.TranscriptionJobStatus == transcribeTypes.TranscriptionJobStatusFailed {
+			reason := aws.ToString(job.FailureReason)
+			if unsupportedFormat != nil && unsupportedFormat.MatchString(reason) {
+				return Transcript{}, fmt.Errorf("%w: transcription job failed: %s", ErrUnsupported, reason)
+			}
+			return Transcript{}, fmt.Errorf("%w: transcription job failed: %s", ErrBackend, reason)
+		}
+		select {
+		case <-ctx.Done():
+			return Transcript{}, fmt.Errorf("%w: %v", ErrNetwork, ctx.Err())
+		case <-time.After(t.PollInterval):
+		}
+	}
+
+	// without an output bucket, the transcript is stored by the service and offered via a pre-signed URL
+	req, err := http.NewRequestWithContext(ctx, "GET", aws.ToString(job.Transcript.TranscriptFileUri), nil)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("error creating request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: error fetching transcript: %v", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+	if *debugSaveResponses != "" {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return Transcript{}, fmt.Errorf("%w: error fetching transcript: %v", ErrNetwork, err)
+		}
+		saveResponse(ctx, req, [][2]string{{"job", jobName}}, resp, body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return Transcript{}, fmt.Errorf("%w: got negative response fetching transcript: „%s“", ErrBackend, string(body))
+	}
+	var result struct {
+		Results struct {
+			Transcripts []struct {
+				Transcript string `json:"transcript"`
+			} `json:"transcripts"`
+			Items []awsTranscriptItem `json:"items"`
+		} `json:"results"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: unable to decode transcript: %v", ErrBackend, err)
+	}
+	transcript := Transcript{Language: string(job.LanguageCode)}
+	if len(result.Results.Transcripts) > 0 {
+		transcript.Text = result.Results.Transcripts[0].Transcript
+	}
+	var confidence float64
+	var words int
+	for _, item := range result.Results.Items {
+		if item.Type == "pronunciation" && len(item.Alternatives) > 0 {
+			value, err := strconv.ParseFloat(item.Alternatives[0].Confidence, 64)
+			if err == nil {
+				confidence += value
+				words++
+			}
+		}
+	}
+	if words > 0 {
+		transcript.Confidence = confidence / float64(words)
+	}
+	if t.Diarize && len(result.Results.Items) > 0 {
+		transcript.Text = formatSpeakers(result.Results.Items)
+	}
+	return transcript, nil
+}
+
+type awsTranscriptItem struct {
+	Type         string `json:"type"`
+	SpeakerLabel string `json:"speaker_label"`
+	Alternatives []struct {
+		Content    string `json:"content"`
+		Confidence string `json:"confidence"`
+	} `json:"alternatives"`
+}
+
+// formatSpeakers puts the words of each speaker on a line of its own, like "Speaker 1: …".
+// Speakers are numbered in the order they first speak. Punctuation has no speaker, it belongs to the previous word.
+func formatSpeakers(items []awsTranscriptItem) string {
+	numbers := make(map[string]int)
+	var lines []string
+	var line strings.Builder
+	current := ""
+	for _, item := range items {
+		if len(item.Alternatives) == 0 {
+			continue
+		}
+		content := item.Alternatives[0].Content
+		if item.Type == "punctuation" {
+			line.WriteString(content)
+			continue
+		}
+		if item.SpeakerLabel != current && item.SpeakerLabel != "" {
+			if line.Len() > 0 {
+				lines = append(lines, line.String())
+				line.Reset()
+			}
+			current = item.SpeakerLabel
+			if _, ok := numbers[current]; !ok {
+				numbers[current] = len(numbers) + 1
+			}
+			fmt.Fprintf(&line, "Speaker %d:", numbers[current])
+		}
+		line.WriteString(" " + content)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// classifyAWSError maps an error returned by the AWS SDK to one of the transcription errors.
+func classifyAWSError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return ErrNetwork
+	}
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "AccessDeniedException", "UnrecognizedClientException", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+		return ErrAuth
+	case "LimitExceededException", "ThrottlingException", "SlowDown":
+		return ErrRateLimited
+	case "EntityTooLarge":
+		return ErrTooLarge
+	case "BadRequestException", "ValidationException", "InvalidRequest":
+		return ErrRequest
+	default:
+		return ErrBackend
+	}
+}
@@ -0,0 +1,83 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// batchExtensions are the file extensions considered audio in batch mode.
+var batchExtensions = []string{".oga", ".ogg", ".opus", ".mp3", ".m4a", ".mp4", ".aac", ".wav", ".flac", ".webm", ".amr"}
+
+// runBatch transcribes all audio files in the directory and its subdirectories.
+// The transcript of each file is written next to it, with the extension replaced by .txt.
+// Files which already have a transcript are skipped.
+func runBatch(dir string) error {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() && isBatchAudio(path) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Transcribing %d files in %s.", len(paths), dir)
+
+	wg := sync.WaitGroup{}
+	slots := make(chan struct{}, max(*concurrency, 1))
+	for _, path := range paths {
+		txtPath := strings.TrimSuffix(path, filepath.Ext(path)) + ".txt"
+		if _, err := os.Stat(txtPath); err == nil {
+			log.Infof("Skipping %s which already has a transcript.", path)
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Warnf("Failed to read %s: %v", path, err)
+				return
+			}
+			audio := Audio{Data: data, Mimetype: mime.TypeByExtension(filepath.Ext(path))}
+			audio = prepareAudio(runCtx, audio)
+			transcript, err := transcribe(runCtx, audio)
+			if err != nil {
+				log.Warnf("Transcription of %s failed: %v", path, err)
+				return
+			}
+			err = os.WriteFile(txtPath, []byte(transcript.Text), 0644)
+			if err != nil {
+				log.Warnf("Failed to write %s: %v", txtPath, err)
+				return
+			}
+			log.Infof("Transcribed %s.", path)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func isBatchAudio(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	for _, batchExtension := range batchExtensions {
+		if extension == batchExtension {
+			return true
+		}
+	}
+	return false
+}
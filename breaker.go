@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of attempting a transcription while the backend is considered down.
+var ErrCircuitOpen = errors.New("backend is considered down")
+
+// circuitBreaker stops using the backend after a number of consecutive failures.
+// Once the cooldown has passed, a single transcription is let through to test whether the backend recovered.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	backend   string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(backend string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{backend: backend, threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports whether a transcription may be attempted.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	log.Infof("Cooldown of backend %s is over, testing whether it recovered.", b.backend)
+	b.probing = true
+	return true
+}
+
+// IsOpen reports whether the backend is considered down, including while testing whether it recovered.
+func (b *circuitBreaker) IsOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// Record takes note of the result of a transcription. Only transient errors count as failures of the backend.
+func (b *circuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || !isTransient(err) {
+		if b.open {
+			log.Infof("Backend %s recovered.", b.backend)
+		}
+		b.failures = 0
+		b.open = false
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || (!b.open && b.failures >= b.threshold) {
+		log.Warnf("Backend %s failed %d times in a row, not using it for %s.", b.backend, b.failures, b.cooldown)
+		b.open = true
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
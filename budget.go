@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBudget bounds the number of bytes held by all transcriptions together.
+// Acquire blocks until enough of the budget has been released by others.
+type memoryBudget struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	changed chan struct{}
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, changed: make(chan struct{})}
+}
+
+// Acquire takes n bytes of the budget. It returns the number of bytes actually taken,
+// which is less than n for requests larger than the whole budget, so they do not block forever.
+func (b *memoryBudget) Acquire(ctx context.Context, n int64) (int64, error) {
+	n = min(n, b.limit)
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return n, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Release returns n bytes to the budget.
+func (b *memoryBudget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
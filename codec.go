@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"mime"
+)
+
+// audioExtension determines the file extension matching the container format of the audio.
+// The format is detected from the first bytes of the data. If that fails, the mimetype
+// announced by the sender is used. Voice messages usually are opus in ogg.
+func audioExtension(data []byte, mimetype string) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "oga"
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")):
+		return "m4a"
+	case bytes.HasPrefix(data, []byte("ID3")) || (len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0 && data[1]&0x06 != 0):
+		// ID3 tag or MPEG audio frame sync (layer bits not zero, to tell it apart from AAC ADTS)
+		return "mp3"
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xF6 == 0xF0:
+		// AAC ADTS frame sync, without a container
+		return "aac"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return "wav"
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "flac"
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "webm"
+	case bytes.HasPrefix(data, []byte("#!AMR")):
+		return "amr"
+	}
+	mediaType, _, _ := mime.ParseMediaType(mimetype)
+	switch mediaType {
+	case "audio/mpeg", "audio/mp3":
+		return "mp3"
+	case "audio/mp4", "audio/x-m4a":
+		return "m4a"
+	case "audio/aac", "audio/aacp":
+		return "aac"
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		return "wav"
+	case "audio/flac", "audio/x-flac":
+		return "flac"
+	case "audio/webm":
+		return "webm"
+	case "audio/amr":
+		return "amr"
+	default:
+		return "oga"
+	}
+}
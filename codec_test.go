@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "testing"
+
+func TestAudioExtension(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		mimetype string
+		want     string
+	}{
+		{"ogg opus", []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00OpusHead"), "", "oga"},
+		{"m4a", []byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00"), "", "m4a"},
+		{"mp4 announced as ogg", []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00"), "audio/ogg; codecs=opus", "m4a"},
+		{"adts", []byte{0xFF, 0xF1, 0x50, 0x80, 0x02, 0x1F, 0xFC}, "", "aac"},
+		{"adts mpeg-2", []byte{0xFF, 0xF9, 0x50, 0x80, 0x02, 0x1F, 0xFC}, "audio/mp4", "aac"},
+		{"amr", []byte("#!AMR\n\x3C"), "", "amr"},
+		{"mp3 with id3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), "", "mp3"},
+		{"mp3 frame", []byte{0xFF, 0xFB, 0x90, 0x64}, "", "mp3"},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "", "wav"},
+		{"unknown data, aac mimetype", []byte("????"), "audio/aac", "aac"},
+		{"unknown data, mpeg mimetype", []byte("????"), "audio/mpeg", "mp3"},
+		{"unknown", nil, "", "oga"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := audioExtension(test.data, test.mimetype)
+			if got != test.want {
+				t.Errorf("audioExtension() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
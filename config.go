@@ -0,0 +1,240 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// reloadableFlags are the flags which can be changed without restarting.
+// Their values are read through settings(), reloadableSettings must have a field for each of them.
+var reloadableFlags = map[string]bool{
+	"message-head":           true,
+	"message-foot":           true,
+	"truncate-length":        true,
+	"truncate-suffix":        true,
+	"forwarded-message-head": true,
+	"skip-forwarded":         true,
+	"skip-captioned":         true,
+	"allowed-categories":     true,
+	"allowed-mimetypes":      true,
+	"language":               true,
+	"chat-languages":         true,
+	"sender-languages":       true,
+	"transcribe-edits":       true,
+	"include-quoted-context": true,
+	"short-threshold":        true,
+	"short-as-reaction":      true,
+	"reply-delay":            true,
+	"quiet-drop":             true,
+	"retries":                true,
+	"download-retries":       true,
+	"retry-empty":            true,
+	"retry-empty-seconds":    true,
+	"expired-message":        true,
+	"decrypt-failed-message": true,
+	"log-usage":              true,
+	"log-response-bodies":    true,
+}
+
+// reloadableSettings are the values of the reloadable flags at one point in time.
+// The flags themselves are only accessed by the main goroutine, everything else reads the settings,
+// so a reload never changes a value while it is being read.
+type reloadableSettings struct {
+	messageHead          string
+	messageFoot          string
+	truncateLength       int
+	truncateSuffix       string
+	forwardedMessageHead string
+	skipForwarded        bool
+	skipCaptioned        bool
+	allowedCategories    string
+	allowedMimetypes     string
+	language             string
+	chatLanguages        string
+	senderLanguages      string
+	transcribeEdits      bool
+	includeQuotedContext bool
+	shortThreshold       int
+	shortAsReaction      bool
+	replyDelay           time.Duration
+	quietDrop            bool
+	retries              int
+	downloadRetries      int
+	retryEmpty           bool
+	retryEmptySeconds    int
+	expiredMessage       string
+	decryptFailedMessage string
+	logUsage             bool
+	logResponseBodies    bool
+}
+
+var currentSettings atomic.Pointer[reloadableSettings]
+
+// settings returns the current values of the reloadable flags. They must not be modified.
+func settings() *reloadableSettings {
+	return currentSettings.Load()
+}
+
+// storeSettings takes the values of the reloadable flags as the current settings.
+// It must be called after the flags have been changed.
+func storeSettings() {
+	currentSettings.Store(&reloadableSettings{
+		messageHead:          *messageHead,
+		messageFoot:          *messageFoot,
+		truncateLength:       *truncateLength,
+		truncateSuffix:       *truncateSuffix,
+		forwardedMessageHead: *forwardedMessageHead,
+		skipForwarded:        *skipForwarded,
+		skipCaptioned:        *skipCaptioned,
+		allowedCategories:    *allowedCategories,
+		allowedMimetypes:     *allowedMimetypes,
+		language:             *languageFlag,
+		chatLanguages:        *chatLanguages,
+		senderLanguages:      *senderLanguages,
+		transcribeEdits:      *transcribeEdits,
+		includeQuotedContext: *includeQuotedContext,
+		shortThreshold:       *shortThreshold,
+		shortAsReaction:      *shortAsReaction,
+		replyDelay:           *replyDelay,
+		quietDrop:            *quietDrop,
+		retries:              *retries,
+		downloadRetries:      *downloadRetries,
+		retryEmpty:           *retryEmpty,
+		retryEmptySeconds:    *retryEmptySeconds,
+		expiredMessage:       *expiredMessage,
+		decryptFailedMessage: *decryptFailedMessage,
+		logUsage:             *logUsage,
+		logResponseBodies:    *logResponseBodies,
+	})
+}
+
+// commandLineFlags are the flags set on the command line. They take precedence over the config file.
+var commandLineFlags = map[string]bool{}
+
+// envPrefix is the prefix of environment variables setting flags, e.g. WMT_MODEL for -model.
+const envPrefix = "WMT_"
+
+// envAliases are environment variables from before there was a naming scheme. They are still honored.
+var envAliases = map[string]string{
+	"api-key": "API_KEY",
+}
+
+// envName returns the name of the environment variable setting the flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// lookupEnv returns the value of the environment variable setting the flag, if there is one.
+func lookupEnv(name string) (string, bool) {
+	if value, ok := os.LookupEnv(envName(name)); ok {
+		return value, true
+	}
+	if alias, ok := envAliases[name]; ok {
+		return os.LookupEnv(alias)
+	}
+	return "", false
+}
+
+// loadEnvironment applies the environment variables to all flags neither set on the command line nor in the config file.
+// The values are taken literally, they may contain a $.
+func loadEnvironment() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(f.Name)
+		if set[f.Name] || !ok || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value for %s in %s: %w", f.Name, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// readConfig reads a config file with one flag per line, e.g. "message-head = Transcript: ".
+// Empty lines and lines starting with # are ignored.
+func readConfig(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		if !ok || flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: not a known flag of the form name = value", path, number)
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+	return values, scanner.Err()
+}
+
+// loadConfig applies the config file to all flags not set on the command line.
+func loadConfig(path string) error {
+	flag.Visit(func(f *flag.Flag) {
+		commandLineFlags[f.Name] = true
+	})
+	values, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if commandLineFlags[name] {
+			continue
+		}
+		err = flag.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value for %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig applies changes of reloadable flags in the config file.
+// Changes of other flags are logged as ignored.
+func reloadConfig(path string) {
+	values, err := readConfig(path)
+	if err != nil {
+		log.Warnf("Failed to reload configuration: %v", err)
+		return
+	}
+	for name, value := range values {
+		value = os.Expand(value, expandEnv)
+		current := flag.Lookup(name).Value.String()
+		if commandLineFlags[name] || value == current {
+			continue
+		}
+		if !reloadableFlags[name] {
+			log.Warnf("Ignoring change of %s in the configuration, it requires a restart.", name)
+			continue
+		}
+		err = flag.Set(name, value)
+		if err != nil {
+			log.Warnf("Ignoring invalid value for %s in the configuration: %v", name, err)
+			continue
+		}
+		log.Infof("Changed %s in the configuration.", name)
+	}
+	storeSettings()
+	log.Infof("Reloaded configuration from %s.", path)
+}
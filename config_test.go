@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// TestReloadConfigWhileReading is meant to be run with -race.
+func TestReloadConfigWhileReading(t *testing.T) {
+	log = waLog.Noop
+	path := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(path, []byte("message-head = Reloaded: \nshort-threshold = 12\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "message-head", "Transcript: ")
+	setFlag(t, "short-threshold", "0")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = replyText(voiceMessage(), "text")
+				_ = isShort("text")
+			}
+		}
+	}()
+	reloadConfig(path)
+	close(stop)
+	wg.Wait()
+
+	if got := settings().messageHead; got != "Reloaded:" {
+		t.Errorf("message-head after reload = %q, want %q", got, "Reloaded:")
+	}
+	if got := settings().shortThreshold; got != 12 {
+		t.Errorf("short-threshold after reload = %d, want 12", got)
+	}
+}
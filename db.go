@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// db is the database also used by the whatsmeow store.
+var db *sql.DB
+
+// migrations create and alter the tables of this program. They are applied in order, each one once.
+// Existing entries must never be changed, append new ones instead.
+var migrations = []string{
+	`CREATE TABLE transcribe_handled (
+		chat       TEXT   NOT NULL,
+		message_id TEXT   NOT NULL,
+		handled_at BIGINT NOT NULL,
+		PRIMARY KEY (chat, message_id)
+	)`,
+	`CREATE TABLE transcribe_transcripts (
+		chat       TEXT    NOT NULL,
+		sender     TEXT    NOT NULL,
+		message_id TEXT    NOT NULL,
+		timestamp  BIGINT  NOT NULL,
+		duration   INTEGER NOT NULL,
+		language   TEXT    NOT NULL,
+		backend    TEXT    NOT NULL,
+		text       TEXT    NOT NULL,
+		latency_ms BIGINT  NOT NULL
+	)`,
+	`CREATE TABLE transcribe_jobs (
+		chat        TEXT   NOT NULL,
+		message_id  TEXT   NOT NULL,
+		enqueued_at BIGINT NOT NULL,
+		info        TEXT   NOT NULL,
+		message     bytea  NOT NULL,
+		PRIMARY KEY (chat, message_id)
+	)`,
+	`CREATE TABLE transcribe_dead_letters (
+		chat       TEXT    NOT NULL,
+		message_id TEXT    NOT NULL,
+		failed_at  BIGINT  NOT NULL,
+		reason     TEXT    NOT NULL,
+		attempts   INTEGER NOT NULL,
+		info       TEXT    NOT NULL,
+		message    bytea   NOT NULL,
+		PRIMARY KEY (chat, message_id)
+	)`,
+}
+
+// upgradeDB applies all migrations which have not been applied yet.
+func upgradeDB() error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS transcribe_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+	version := 0
+	err = db.QueryRow("SELECT version FROM transcribe_version").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = db.Exec("INSERT INTO transcribe_version (version) VALUES (0)")
+	}
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[version])
+		if err == nil {
+			_, err = tx.Exec("UPDATE transcribe_version SET version = $1", version+1)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimMessage records that the message is being handled.
+// It returns false if the message had already been handled before, e.g. before a restart.
+func claimMessage(chat types.JID, id types.MessageID) (bool, error) {
+	result, err := db.Exec("INSERT INTO transcribe_handled (chat, message_id, handled_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", chat.String(), id, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+// releaseMessage forgets that the message has been handled so it is handled again if it is delivered again.
+func releaseMessage(chat types.JID, id types.MessageID) {
+	_, err := db.Exec("DELETE FROM transcribe_handled WHERE chat = $1 AND message_id = $2", chat.String(), id)
+	if err != nil {
+		log.Warnf("Failed to release message %s: %v", id, err)
+	}
+}
+
+// storeTranscript records the transcript for later analysis.
+// The timestamp is stored as 0 in case it is unknown.
+func storeTranscript(evt *events.Message, seconds uint32, transcript Transcript, latency time.Duration) {
+	timestamp := int64(0)
+	if !evt.Info.Timestamp.IsZero() {
+		timestamp = evt.Info.Timestamp.Unix()
+	}
+	_, err := db.Exec("INSERT INTO transcribe_transcripts (chat, sender, message_id, timestamp, duration, language, backend, text, latency_ms) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		evt.Info.Chat.String(), evt.Info.Sender.ToNonAD().String(), evt.Info.ID, timestamp, seconds, transcript.Language, transcript.Backend, transcript.Text, latency.Milliseconds())
+	if err != nil {
+		log.Warnf("Failed to store transcript of message %s: %v", evt.Info.ID, err)
+	}
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// openTestDB opens (and upgrades) the database in the file, as done on start.
+func openTestDB(t *testing.T, path string) {
+	t.Helper()
+	var err error
+	db, err = sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = upgradeDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimMessageAfterRestart(t *testing.T) {
+	log = waLog.Noop
+	path := filepath.Join(t.TempDir(), "test.db")
+	chat := types.NewJID("491701234567", types.DefaultUserServer)
+	other := types.NewJID("491709876543", types.DefaultUserServer)
+
+	openTestDB(t, path)
+	claimed, err := claimMessage(chat, "ABC")
+	if err != nil || !claimed {
+		t.Fatalf("first delivery: claimed=%v err=%v, want claimed", claimed, err)
+	}
+	db.Close()
+
+	// the same database after a restart, the message is delivered again
+	openTestDB(t, path)
+	defer db.Close()
+	claimed, err = claimMessage(chat, "ABC")
+	if err != nil || claimed {
+		t.Fatalf("redelivery after restart: claimed=%v err=%v, want not claimed", claimed, err)
+	}
+	claimed, err = claimMessage(other, "ABC")
+	if err != nil || !claimed {
+		t.Fatalf("same ID in another chat: claimed=%v err=%v, want claimed", claimed, err)
+	}
+
+	releaseMessage(chat, "ABC")
+	claimed, err = claimMessage(chat, "ABC")
+	if err != nil || !claimed {
+		t.Fatalf("redelivery after release: claimed=%v err=%v, want claimed", claimed, err)
+	}
+}
@@ -0,0 +1,98 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Voice messages which could not be transcribed are kept as dead letters, so they can be retried later,
+// e.g. after an outage of the backend or after fixing the API key. The message contains the keys of the media,
+// so it can be downloaded again for as long as WhatsApp keeps it.
+
+// saveDeadLetter records that the message could not be transcribed.
+func saveDeadLetter(evt *events.Message, reason error, attempts int) {
+	info, err := json.Marshal(evt.Info)
+	if err != nil {
+		log.Warnf("Failed to keep message %s as dead letter: %v", evt.Info.ID, err)
+		return
+	}
+	message, err := proto.Marshal(evt.Message)
+	if err != nil {
+		log.Warnf("Failed to keep message %s as dead letter: %v", evt.Info.ID, err)
+		return
+	}
+	_, err = db.Exec(`INSERT INTO transcribe_dead_letters (chat, message_id, failed_at, reason, attempts, info, message) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (chat, message_id) DO UPDATE SET failed_at = excluded.failed_at, reason = excluded.reason, attempts = transcribe_dead_letters.attempts + excluded.attempts`,
+		evt.Info.Chat.String(), evt.Info.ID, time.Now().Unix(), reason.Error(), attempts, string(info), message)
+	if err != nil {
+		log.Warnf("Failed to keep message %s as dead letter: %v", evt.Info.ID, err)
+	}
+}
+
+// retryDeadLetters queues all dead letters again. They are removed from the store,
+// a voice message failing again becomes a dead letter again.
+func retryDeadLetters() {
+	rows, err := db.Query("SELECT info, message, reason, attempts FROM transcribe_dead_letters ORDER BY failed_at")
+	if err != nil {
+		log.Errorf("Failed to load dead letters: %v", err)
+		return
+	}
+	var letters []*events.Message
+	for rows.Next() {
+		var info, reason string
+		var message []byte
+		var attempts int
+		err = rows.Scan(&info, &message, &reason, &attempts)
+		if err != nil {
+			break
+		}
+		evt := &events.Message{Message: &waProto.Message{}}
+		// a single unreadable dead letter does not fail the others
+		decodeErr := json.Unmarshal([]byte(info), &evt.Info)
+		if decodeErr == nil {
+			decodeErr = proto.Unmarshal(message, evt.Message)
+		}
+		if decodeErr != nil {
+			log.Warnf("Skipping unreadable dead letter: %v", decodeErr)
+			continue
+		}
+		log.Debugf("Retrying message %s which failed %d times, last due to: %s", evt.Info.ID, attempts, reason)
+		letters = append(letters, evt)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		log.Errorf("Failed to load dead letters: %v", err)
+		return
+	}
+	log.Infof("Retrying %d voice messages which could not be transcribed before.", len(letters))
+	for _, evt := range letters {
+		_, err = db.Exec("DELETE FROM transcribe_dead_letters WHERE chat = $1 AND message_id = $2", evt.Info.Chat.String(), evt.Info.ID)
+		if err != nil {
+			log.Warnf("Failed to delete dead letter of message %s: %v", evt.Info.ID, err)
+			continue
+		}
+		media := findAudio(evt.Message)
+		if len(media) == 0 {
+			continue
+		}
+		if *durableQueue {
+			err = saveJob(evt)
+			if err != nil {
+				log.Warnf("Failed to save job of message %s: %v", evt.Info.ID, err)
+			}
+		}
+		queueAudio(evt, media)
+	}
+}
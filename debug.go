@@ -0,0 +1,72 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// debugRecord is what is saved of an API response for debugging.
+type debugRecord struct {
+	Time            time.Time         `json:"time"`
+	MessageID       string            `json:"message_id,omitempty"`
+	RequestID       string            `json:"request_id,omitempty"`
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	Parameters      [][2]string       `json:"parameters,omitempty"`
+	Status          int               `json:"status"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	Body            string            `json:"body"`
+}
+
+// saveResponse writes the response with the details of the request to the debug directory.
+// The API key is left out, as is the query of the URL, which may contain credentials.
+func saveResponse(ctx context.Context, req *http.Request, parameters [][2]string, resp *http.Response, body []byte) {
+	url := *req.URL
+	url.RawQuery = ""
+	record := debugRecord{
+		Time:            time.Now(),
+		MessageID:       messageID(ctx),
+		RequestID:       requestID(ctx),
+		Method:          req.Method,
+		URL:             url.String(),
+		RequestHeaders:  flattenHeaders(req.Header),
+		Parameters:      parameters,
+		Status:          resp.StatusCode,
+		ResponseHeaders: flattenHeaders(resp.Header),
+		Body:            string(body),
+	}
+	name := record.MessageID
+	if name == "" {
+		name = "unknown"
+	}
+	// a message may be transcribed more than once
+	name = fmt.Sprintf("%s-%d.json", filepath.Base(name), record.Time.UnixMilli())
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(*debugSaveResponses, name), data, 0600)
+	}
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to save response for debugging: %v", err)
+	}
+}
+
+func flattenHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		if name == "Authorization" {
+			continue
+		}
+		flat[name] = values[0]
+	}
+	return flat
+}
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// The durable queue keeps a copy of each queued voice message in the database until it has been handled.
+// Voice messages which have not been handled when the program stops (or crashes) are handled after a restart.
+
+// saveJob stores the message in the database.
+func saveJob(evt *events.Message) error {
+	info, err := json.Marshal(evt.Info)
+	if err != nil {
+		return err
+	}
+	message, err := proto.Marshal(evt.Message)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO transcribe_jobs (chat, message_id, enqueued_at, info, message) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING",
+		evt.Info.Chat.String(), evt.Info.ID, time.Now().UnixNano(), string(info), message)
+	return err
+}
+
+// deleteJob removes the job of the message from the database.
+func deleteJob(chat types.JID, id types.MessageID) {
+	_, err := db.Exec("DELETE FROM transcribe_jobs WHERE chat = $1 AND message_id = $2", chat.String(), id)
+	if err != nil {
+		log.Warnf("Failed to delete job of message %s: %v", id, err)
+	}
+}
+
+// loadJobs returns the messages of all stored jobs, oldest first.
+func loadJobs() ([]*events.Message, error) {
+	rows, err := db.Query("SELECT info, message FROM transcribe_jobs ORDER BY enqueued_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []*events.Message
+	for rows.Next() {
+		var info string
+		var message []byte
+		err = rows.Scan(&info, &message)
+		if err != nil {
+			return nil, err
+		}
+		evt := &events.Message{Message: &waProto.Message{}}
+		err = json.Unmarshal([]byte(info), &evt.Info)
+		if err == nil {
+			err = proto.Unmarshal(message, evt.Message)
+		}
+		if err != nil {
+			log.Warnf("Dropping unreadable job: %v", err)
+			continue
+		}
+		jobs = append(jobs, evt)
+	}
+	return jobs, rows.Err()
+}
+
+// resumeJobs queues all jobs left over from a previous run.
+func resumeJobs() {
+	jobs, err := loadJobs()
+	if err != nil {
+		log.Errorf("Failed to load jobs: %v", err)
+		return
+	}
+	if len(jobs) > 0 {
+		log.Infof("Resuming %d voice messages left over from the last run.", len(jobs))
+	}
+	for _, evt := range jobs {
+		media := findAudio(evt.Message)
+		if len(media) == 0 {
+			deleteJob(evt.Info.Chat, evt.Info.ID)
+			continue
+		}
+		queueAudio(evt, media)
+	}
+}
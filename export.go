@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// exportDateLayout is the layout of the dates limiting the export.
+const exportDateLayout = "2006-01-02"
+
+// exportTranscripts writes the stored transcripts of the chat to the file in chronological order.
+// Only voice messages sent on or after since and on or before until are included, empty dates do not limit the export.
+// Voice messages cannot be transcribed again, since only the transcripts are stored, not the messages.
+func exportTranscripts(chat types.JID, since, until string, path string) error {
+	start := time.Unix(0, 0)
+	end := time.Now()
+	var err error
+	if since != "" {
+		start, err = time.ParseInLocation(exportDateLayout, since, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid start date: %w", err)
+		}
+	}
+	if until != "" {
+		end, err = time.ParseInLocation(exportDateLayout, until, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid end date: %w", err)
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	rows, err := db.Query("SELECT sender, timestamp, duration, text FROM transcribe_transcripts WHERE chat = $1 AND timestamp >= $2 AND timestamp < $3 ORDER BY timestamp, message_id",
+		chat.String(), start.Unix(), end.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	fmt.Fprintf(w, "Voice messages in %s\n", chat)
+	count := 0
+	for rows.Next() {
+		var sender, text string
+		var timestamp int64
+		var seconds int
+		err = rows.Scan(&sender, &timestamp, &seconds, &text)
+		if err != nil {
+			break
+		}
+		if jid, err := types.ParseJID(sender); err == nil {
+			sender = jid.User
+		}
+		sent := "(time unknown)"
+		if timestamp != 0 {
+			sent = time.Unix(timestamp, 0).Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(w, "\n%s %s (%s):\n%s\n", sent, sender, formatDuration(time.Duration(seconds)*time.Second), text)
+		count++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("Exported %d transcripts of %s to %s.", count, chat, path)
+	return nil
+}
@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// forwardChat receives a copy of every transcript, if set.
+var forwardChat types.JID
+
+// forwardTranscript sends the transcript to the forward chat along with a citation of the voice message.
+// WhatsApp has no links to messages, so the citation names the chat, the sender, the time and the message ID.
+func forwardTranscript(ctx context.Context, evt *events.Message, text string) {
+	msg := &waProto.Message{Conversation: proto.String(citation(ctx, evt) + "\n\n" + text)}
+	err := sendMessage(ctx, forwardChat, msg)
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to forward transcript of message %s: %v", evt.Info.ID, err)
+	}
+}
+
+func citation(ctx context.Context, evt *events.Message) string {
+	chat := "private chat"
+	switch {
+	case evt.Info.Chat == types.StatusBroadcastJID:
+		chat = "status update"
+	case evt.Info.Chat.Server == types.NewsletterServer:
+		chat = "channel " + evt.Info.Chat.String()
+	case evt.Info.IsGroup:
+		chat = evt.Info.Chat.String()
+		info, err := client().GetGroupInfo(evt.Info.Chat)
+		if err != nil {
+			loggerFor(ctx).Warnf("Failed to get name of group %s: %v", redactJID(evt.Info.Chat), err)
+		} else if info.Name != "" {
+			chat = info.Name
+		}
+	}
+	sent := ""
+	if !evt.Info.Timestamp.IsZero() {
+		sent = ", " + evt.Info.Timestamp.Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("📝 %s, %s (+%s)%s\nMessage ID: %s", chat, evt.Info.PushName, evt.Info.Sender.User, sent, evt.Info.ID)
+}
@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// recentIDs remembers message IDs for a while.
+type recentIDs struct {
+	mu        sync.Mutex
+	retention time.Duration
+	ids       map[types.MessageID]time.Time
+}
+
+func newRecentIDs(retention time.Duration) *recentIDs {
+	return &recentIDs{retention: retention, ids: make(map[types.MessageID]time.Time)}
+}
+
+func (r *recentIDs) Add(id types.MessageID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for known, addedAt := range r.ids {
+		if now.Sub(addedAt) > r.retention {
+			delete(r.ids, known)
+		}
+	}
+	r.ids[id] = now
+}
+
+func (r *recentIDs) Contains(id types.MessageID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ids[id]
+	return ok
+}
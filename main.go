@@ -3,23 +3,26 @@
 // file, You can obtain one at http://mozilla.org/MPL/2.0/.
 
 // This is a trimmed copy of https://github.com/tulir/whatsmeow/blob/main/mdtest/main.go
-// with the getTranscription function added.
+// with transcription added.
 
 package main
 
 import (
-	"bytes"
 	"context"
+	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"mime/multipart"
-	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mdp/qrterminal/v3"
@@ -28,6 +31,7 @@ import (
 	"go.mau.fi/whatsmeow"
 	waBinary "go.mau.fi/whatsmeow/binary"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waCompanionReg"
 	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
@@ -35,29 +39,265 @@ import (
 	waLog "go.mau.fi/whatsmeow/util/log"
 )
 
-var cli *whatsmeow.Client
+// activeClient is the connection to WhatsApp. It is replaced when pairing again after being logged out,
+// so it is only accessed through client().
+var activeClient atomic.Pointer[whatsmeow.Client]
+
+// client returns the current connection to WhatsApp.
+func client() *whatsmeow.Client {
+	return activeClient.Load()
+}
+
+// messageSender and mediaDownloader are the parts of the client the transcription depends on.
+// They are satisfied by liveClient and can be replaced for testing without a connection.
+type messageSender interface {
+	SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+	GenerateMessageID() types.MessageID
+}
+
+type mediaDownloader interface {
+	Download(msg whatsmeow.DownloadableMessage) ([]byte, error)
+}
+
+// liveClient passes everything on to the current client.
+type liveClient struct{}
+
+func (liveClient) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	return client().SendMessage(ctx, to, message, extra...)
+}
+
+func (liveClient) GenerateMessageID() types.MessageID {
+	return client().GenerateMessageID()
+}
+
+func (liveClient) Download(msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	return client().Download(msg)
+}
+
+var messenger messageSender
+var downloader mediaDownloader
+var storeContainer *sqlstore.Container
 var log waLog.Logger
+var transcriber Transcriber
+
+// chatTranscribers are the backends other than the default one used for some chats, by name.
+var chatTranscribers = make(map[string]Transcriber)
+
+var queue *chatQueue
+
+// downloadSlots limits the number of downloads in parallel, nil for no limit beyond the queue.
+var downloadSlots chan struct{}
+var replyLimiter *chatRateLimiter
+var budget *memoryBudget
+var volume *volumeMonitor
+var cleaner *Cleaner
+var transcriptionTimeout time.Duration
+
+// breakers are the circuit breakers of the backends by name, nil if disabled.
+var breakers map[string]*circuitBreaker
+
+// transcribedCount is the number of voice messages transcribed successfully.
+var transcribedCount atomic.Int64
+
+// rejectedCount is the number of voice messages rejected since the queue was full.
+var rejectedCount atomic.Int64
+var quiet *quietHours
 
 var quitter = make(chan struct{})
+var quitOnce sync.Once
+var exitCode int
+
+// quit has the program shut down and exit with the code.
+func quit(code int) {
+	quitOnce.Do(func() {
+		exitCode = code
+		close(quitter)
+	})
+}
+
+// runCtx is cancelled once the program is shutting down.
+var runCtx, stopRunning = context.WithCancel(context.Background())
+
+// connectedAt is the time of the first successful connection in this process.
+var connectedAt time.Time
+var annotations *regexp.Regexp
+
+// maxDeviceNameLength is a conservative limit, longer names are not displayed in full by the phone.
+const maxDeviceNameLength = 50
 
 var logLevel = "INFO"
+var configFile = flag.String("config", "", "File to read flags from, one \"name = value\" per line. It is reloaded on SIGHUP.")
 var debugLogs = flag.Bool("debug", false, "Enable debug logs?")
+var redactPII = flag.Bool("redact-pii", false, "Mask phone numbers and names in logs")
 var dbDialect = flag.String("db-dialect", "sqlite3", "Database dialect (sqlite3 or postgres)")
 var dbAddress = flag.String("db-address", "file:whatsmeow.db?_foreign_keys=on", "Database address")
-var apiUrl = flag.String("api-url", "https://api.openai.com/v1/audio/transcriptions", "Transcription API URL")
-var apiKey = flag.String("api-key", "", "Transcription API Key")
+var dbMaintenanceInterval = flag.Duration("db-maintenance-interval", 0, "Prune expired rows and compact the database at this interval, e.g. 24h (0 to disable)")
+var handledRetention = flag.Duration("handled-retention", 30*24*time.Hour, "With db-maintenance-interval, forget handled messages after this time (0 to keep them)")
+var transcriptRetention = flag.Duration("transcript-retention", 0, "With db-maintenance-interval, delete stored transcripts older than this (0 to keep them)")
+var exportChat = flag.String("export-chat", "", "Do not connect to WhatsApp, export the stored transcripts of this chat to export-file instead")
+var exportSince = flag.String("export-since", "", "Export only voice messages sent on or after this date, e.g. 2024-01-31")
+var exportUntil = flag.String("export-until", "", "Export only voice messages sent on or before this date, e.g. 2024-12-31")
+var exportFile = flag.String("export-file", "transcripts.txt", "File to export the transcripts of export-chat to")
+var batchDir = flag.String("batch-dir", "", "Do not connect to WhatsApp, transcribe the audio files in this directory instead")
+var deviceName = flag.String("device-name", "whatsmeow-transcribe", "Name shown in the list of linked devices on the phone")
+var devicePlatform = flag.String("device-platform", "", "Platform to present as when pairing, e.g. CHROME or DESKTOP (experimental, empty for the default of the WhatsApp library)")
+var noQR = flag.Bool("no-qr", false, "Do not offer QR code pairing, fail if the device is not paired yet")
+var reconnectMaxAttempts = flag.Int("reconnect-max-attempts", 0, "Reconnect after being disconnected, exit with an error after this many failed attempts (0 for no limit)")
+var reconnectMaxDuration = flag.Duration("reconnect-max-duration", 0, "Reconnect after being disconnected, exit with an error in case the connection is not back within this time (0 for no limit)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 0, "On interrupt, wait this long for transcriptions in progress to finish before exiting (0 to cancel them right away)")
+var reloginFlag = flag.Bool("relogin", false, "Offer to pair again by QR code in case the device gets logged out")
+var backend = flag.String("backend", "openai", "Transcription backend (openai, faster-whisper, aws or vosk)")
+var apiUrl = flag.String("api-url", "https://api.openai.com/v1/audio/transcriptions", "Transcription API URL (faster-whisper defaults to http://localhost:8000/v1/audio/transcriptions)")
+var model = flag.String("model", "", "Transcription model (defaults to whisper-1 for openai and Systran/faster-whisper-small for faster-whisper)")
+var modelPath = flag.String("model-path", "", "Directory of the model for the vosk backend")
+var responseTextPath = flag.String("response-text-path", "", "Path of the transcript in the JSON response of the API, e.g. results.transcripts[0].text (empty for OpenAI's response format)")
+var modelField = flag.String("model-field", "model", "Name of the form field for the model in the transcription request")
+var fileField = flag.String("file-field", "file", "Name of the form field for the audio in the transcription request")
+var apiKeyFlag = flag.String("api-key", "", "Transcription API Key, several keys may be given as a comma separated list")
+var apiKeyFile = flag.String("api-key-file", "", "File to read the transcription API key from, it is reloaded when the file changes")
+var httpTimeout = flag.Duration("http-timeout", 0, "Time limit for transcribing a voice message (0 for the default of the backend: 2m for openai, 10m for faster-whisper and vosk, 15m for aws)")
+var tlsMinVersion = flag.String("tls-min-version", "", "Minimum TLS version for connections to the transcription API (1.2 or 1.3, empty for the default)")
+var openAIOrg = flag.String("openai-org", "", "OpenAI organization ID to bill transcriptions to")
+var openAIProject = flag.String("openai-project", "", "OpenAI project ID to bill transcriptions to")
+var awsRegion = flag.String("aws-region", "", "AWS region for Amazon Transcribe (empty for the configured default)")
+var awsBucket = flag.String("aws-bucket", "", "S3 bucket for temporarily storing audio for Amazon Transcribe")
+var diarize = flag.Bool("diarize", false, "Tell the speakers apart, replying with one line per speaker (only supported by aws)")
+var maxSpeakers = flag.Int("max-speakers", 4, "Maximum number of speakers to tell apart with diarize (2 to 30)")
+var awsRole = flag.String("aws-role", "", "ARN of an AWS role to assume for Amazon Transcribe")
 var messageHead = flag.String("message-head", "Transcript:\n> ", "Text to start message with")
+var showDuration = flag.Bool("show-duration", false, "Start the transcript with the length of the voice message, e.g. 🎙️ 0:47")
+var structuredReply = flag.Bool("structured-reply", false, "Reply with the transcript and its details as JSON in a code block, for bots to parse")
+var truncateLength = flag.Int("truncate-length", 0, "Shorten transcripts to at most this many characters, at a word boundary (0 for no limit)")
+var truncateSuffix = flag.String("truncate-suffix", "…", "Text to end shortened transcripts with, e.g. \"… (truncated)\"")
+var messageFoot = flag.String("message-foot", "", "Text to end message with")
+var showStats = flag.Bool("show-stats", false, "Start replies with the number of words and the estimated reading time")
+var readingWPM = flag.Int("reading-wpm", 200, "Words per minute for estimating the reading time")
+var forwardedMessageHead = flag.String("forwarded-message-head", "", "Text to start message with in case the voice message was forwarded (empty for message-head)")
+var skipForwarded = flag.Bool("skip-forwarded", false, "Do not transcribe forwarded voice messages")
+var skipCaptioned = flag.Bool("skip-captioned", false, "Do not transcribe audio documents which have a caption already")
+var maxMessages = flag.Int("max-messages", 0, "Stop transcribing after this many voice messages, e.g. for trying out the API (0 for no limit)")
+var maxMessagesExit = flag.Bool("max-messages-exit", false, "Exit once max-messages voice messages have been transcribed")
+var concurrency = flag.Int("concurrency", 4, "Number of chats to process voice messages for in parallel")
+var queueSize = flag.Int("queue-size", 0, "Maximum number of voice messages waiting to be processed, further ones are rejected (0 for no limit)")
+var queueFullMessage = flag.String("queue-full-message", "(busy, try again later)", "Reply to voice messages rejected since the queue is full (empty for not replying)")
+var downloadConcurrency = flag.Int("download-concurrency", 0, "Number of voice messages to download in parallel, at most concurrency (0 for no separate limit)")
+var streamMedia = flag.Bool("stream-media", false, "Stream the audio into the transcription request instead of assembling the request in memory")
+var memoryBudgetMB = flag.Int("memory-budget", 0, "Maximum number of megabytes of audio held in memory by all transcriptions together (0 for no limit)")
+var dispatchJitter = flag.Duration("dispatch-jitter", 0, "Wait for a random time up to this before processing each voice message, e.g. 2s")
+var downloadRetries = flag.Int("download-retries", 2, "Number of times to retry downloading a voice message after a transient failure")
+var chatReplyRate = flag.Int("chat-reply-rate", 0, "Maximum number of replies per chat and minute, further voice messages are skipped (0 for no limit)")
+var debugSaveResponses = flag.String("debug-save-responses", "", "Directory to save each raw API response with the request parameters to, for debugging")
+var logResponseBodies = flag.Bool("log-response-bodies", false, "Log the body of negative responses of the transcription API (may contain sensitive data)")
+var optimizeUpload = flag.Bool("optimize-upload", false, "Transcode the audio to 16 kHz mono opus before uploading it to the backend (needs ffmpeg)")
+var normalizeAudio = flag.Bool("normalize-audio", false, "Normalize the loudness of the audio before uploading it to the backend, which helps with quiet recordings (needs ffmpeg, implies optimize-upload)")
+var ffmpegPath = flag.String("ffmpeg", "ffmpeg", "Path to the ffmpeg executable")
+var ffprobePath = flag.String("ffprobe", "ffprobe", "Path to the ffprobe executable")
+var unsupportedFormatPattern = flag.String("unsupported-format-pattern", `(?i)unsupported|invalid file format|could not be decoded|failed to decode|not a valid (audio|media)`, "Regular expression recognizing a backend response which complains about the audio format")
+var unsupportedFormatMessage = flag.String("unsupported-format-message", "(unsupported audio format)", "Text to reply with in case the backend cannot read the audio and converting it did not help (empty for no reply)")
+var streamFlag = flag.Bool("stream", false, "Request a streamed response and update the reply while the transcript comes in (only supported by some models)")
+var cleanup = flag.Bool("cleanup", false, "Have a chat completion API fix punctuation and remove filler words before replying (extra cost and latency)")
+var cleanupKeepRaw = flag.Bool("cleanup-keep-raw", false, "Reply with the verbatim transcript below the cleaned up one")
+var cleanupURL = flag.String("cleanup-url", "https://api.openai.com/v1/chat/completions", "Chat completion API URL for cleaning up transcripts")
+var cleanupModel = flag.String("cleanup-model", "gpt-4o-mini", "Model for cleaning up transcripts")
+var cleanupPrompt = flag.String("cleanup-prompt", "The user message is the transcript of a voice message. Fix punctuation and remove filler words and repetitions. Do not change the meaning, the language or the wording otherwise. Reply with the corrected transcript only.", "Instructions for cleaning up transcripts")
+var breakerFailures = flag.Int("breaker-failures", 0, "Stop using the backend for a while after this many failed transcriptions in a row (0 to never stop)")
+var breakerCooldown = flag.Duration("breaker-cooldown", time.Minute, "Time to stop using the backend for after too many failures")
+var breakerMessage = flag.String("breaker-message", "", "Text to reply with in case a voice message is skipped since the backend is down (empty for no reply)")
+var lowConfidence = flag.Float64("low-confidence", 0, "Mark transcripts with a confidence below this (between 0 and 1) as possibly inaccurate (0 to never mark)")
+var lowConfidenceMarker = flag.String("low-confidence-marker", "(low confidence — may be inaccurate)", "Text to append to transcripts with low confidence")
+var retryEmpty = flag.Bool("retry-empty", false, "Retry once in case the transcript is empty although the voice message is not very short")
+var retryEmptySeconds = flag.Int("retry-empty-seconds", 3, "Minimum duration of a voice message for retrying on an empty transcript")
+var replyDelay = flag.Duration("reply-delay", 0, "Wait this long after transcribing before replying, e.g. 3s")
+var quietStart = flag.String("quiet-start", "", "Start of the daily quiet hours without replies (HH:MM)")
+var quietEnd = flag.String("quiet-end", "", "End of the daily quiet hours without replies (HH:MM)")
+var quietTimezone = flag.String("quiet-timezone", "Local", "Timezone of the quiet hours, e.g. Europe/Berlin")
+var quietDrop = flag.Bool("quiet-drop", false, "Drop replies due in the quiet hours rather than sending them afterwards")
+var retries = flag.Int("retries", 2, "Number of times to retry a transcription after a transient failure")
+var logUsage = flag.Bool("log-usage", false, "Log the duration of each transcription and the usage reported by the API")
+var languageFlag = flag.String("language", "", "Language spoken in voice messages, e.g. en (empty to have the backend detect it)")
+var chatBackends = flag.String("chat-backends", "", "Comma separated list of chats and the backend to use for them, e.g. 123456789-987654321@g.us=aws (all others use -backend)")
+var chatLanguages = flag.String("chat-languages", "", "Comma separated list of chats and their language, e.g. 123456789-987654321@g.us=de")
+var senderLanguages = flag.String("sender-languages", "", "Comma separated list of senders and their language, e.g. 491701234567=de")
+var onlyLanguages = flag.String("only-languages", "", "Comma separated list of languages to reply to, all others are skipped")
+var skipLanguages = flag.String("skip-languages", "", "Comma separated list of languages not to reply to")
+var transcriptDir = flag.String("transcript-dir", "", "Directory to archive each transcript in as a text file")
+var transcriptFilenameTemplate = flag.String("transcript-filename", "{date}_{chat}_{id}.txt", "Name of the transcript files, with the placeholders {date}, {time}, {chat}, {sender} and {id} (may contain subdirectories)")
+var storeTranscripts = flag.Bool("store-transcripts", false, "Store all transcripts in the database for later analysis")
+var transcriptLog = flag.String("transcript-log", "", "File to append all transcripts to, one JSON object per line")
+var alertFactor = flag.Float64("alert-factor", 0, "Warn and post an alert to the webhook in case the hourly transcription volume exceeds its average by this factor (0 for no alerts)")
+var serveTranscribeAddr = flag.String("serve-transcribe-addr", "", "Address to offer the transcription as HTTP endpoint at, e.g. localhost:8080 (empty for no endpoint)")
+var serveTranscribeToken = flag.String("serve-transcribe-token", "", "Token clients of the transcription endpoint need to send as bearer token (empty for no authentication)")
+var webhookURL = flag.String("webhook-url", "", "URL to post all transcripts to as JSON")
+var retryDecryptionFlag = flag.Bool("retry-decryption", false, "Download the audio once more in case it could not be decrypted")
+var decryptFailedMessage = flag.String("decrypt-failed-message", "", "Text to reply with in case a voice message could not be decrypted (empty for no reply)")
+var expiredMessage = flag.String("expired-message", "", "Text to reply with in case a voice message is no longer available for download (empty for no reply)")
+var startupGrace = flag.Duration("startup-grace", 0, "Ignore voice messages received within this time after connecting, e.g. 30s")
+var deadLetters = flag.Bool("dead-letters", false, "Keep voice messages which could not be transcribed in the database, so they can be retried later")
+var retryDeadLettersFlag = flag.Bool("retry-dead-letters", false, "Retry all voice messages kept as dead letters after connecting")
+var durableQueue = flag.Bool("durable-queue", false, "Keep queued voice messages in the database, so they are handled after a restart or crash")
+var dedup = flag.Bool("dedup", true, "Remember handled voice messages in the database so they are never replied to twice, even after a restart")
+var revokeCommandFlag = flag.Bool("revoke-command", false, "With on-mention, delete the message requesting the transcript once it has been sent")
+var transcribeQuoted = flag.Bool("transcribe-quoted", false, "Transcribe voice messages someone replies to, in case they have not been transcribed already (needs dedup)")
+var onMention = flag.Bool("on-mention", false, "In groups, only transcribe voice messages when someone replies to them mentioning this account")
+var skipHistory = flag.Bool("skip-history", true, "Ignore voice messages sent before the program connected (history and offline messages)")
+var transcribeAudioDocuments = flag.Bool("transcribe-audio-documents", false, "Also transcribe documents with an audio mimetype")
+var thread = flag.String("thread", "each", "How to thread transcripts: \"each\" replies to its voice message, \"first\" replies to the first of consecutive voice messages by the same sender, \"none\" does not quote")
+var includeQuotedContext = flag.Bool("include-quoted-context", false, "If the voice message is a reply, start the transcript with the text it replies to")
+var stripAnnotationsFlag = flag.Bool("strip-annotations", false, "Remove non-speech annotations like [music] or (inaudible) from transcripts before replying")
+var annotationPattern = flag.String("annotation-pattern", `\[[^\]]*\]|\([^)]*\)|\*[^*]*\*|[♪♫]+`, "Regular expression matching the annotations removed by strip-annotations")
+var transcribeStatus = flag.Bool("transcribe-status", false, "Transcribe voice messages posted as status update (the transcripts are logged, not replied)")
+var transcribeNewsletters = flag.Bool("transcribe-newsletters", false, "Transcribe voice messages posted in followed channels (the transcripts are logged, not replied)")
+var adminJID = flag.String("admin-jid", "", "JID of a chat to notify in case the transcription API key is not accepted")
+var adminAuthFailures = flag.Int("admin-auth-failures", 3, "Number of consecutive authentication failures after which the admin is notified")
+var adminNoticeCooldown = flag.Duration("admin-notice-cooldown", time.Hour, "Minimum time between two notices to the admin")
+var adminAuthMessage = flag.String("admin-auth-message", "⚠️ The transcription API key is missing or invalid. Voice messages are not transcribed until it is fixed.", "Text to notify the admin with in case the API key is not accepted")
+var forwardTo = flag.String("forward-to", "", "JID of a chat to send a copy of every transcript to, along with where it came from")
+var selfChatOnly = flag.Bool("self-chat-only", false, "Only transcribe voice messages sent by this account, and deliver the transcripts to its own chat (\"message yourself\")")
+var allowedCategories = flag.String("allowed-categories", "normal", "Comma separated list of message categories to transcribe, e.g. normal,peer (\"normal\" are messages without a category)")
+var allowedMimetypes = flag.String("allowed-mimetypes", "audio/ogg,audio/opus,audio/mpeg,audio/mp4,audio/aac,audio/wav,audio/x-wav,audio/webm,audio/flac", "Comma separated list of mimetypes of audio to transcribe")
+var transcribeAllAudio = flag.Bool("transcribe-all-audio", false, "Also transcribe audio messages which are not voice messages")
+var musicMinSeconds = flag.Int("music-min-seconds", 90, "Audio other than voice messages of this duration or longer and of a music mimetype is considered music and not transcribed (0 to transcribe everything)")
+var musicMimetypes = flag.String("music-mimetypes", "audio/mpeg,audio/flac,audio/x-flac", "Comma separated list of mimetypes which are typically used for music")
+var musicMessage = flag.String("music-message", "", "Text to reply with instead of a transcript in case the audio is likely music (empty for no reply)")
+var skipPlayed = flag.Bool("skip-played", false, "Do not transcribe voice messages which have been played on another device of the account already")
+var skipPlayedWait = flag.Duration("skip-played-wait", 0, "With skip-played, wait this long before transcribing, giving the recipient time to play the voice message, e.g. 1m")
+var transcribeEdits = flag.Bool("transcribe-edits", false, "Transcribe the audio of edited messages again")
+var asCaption = flag.Bool("as-caption", false, "Attach the transcript to your own audio documents as caption instead of replying")
+var reactProgress = flag.Bool("react-progress", false, "React to voice messages to indicate the progress of the transcription")
+var reactStart = flag.String("react-start", "⏳", "Reaction while a voice message is being transcribed")
+var reactDone = flag.String("react-done", "✅", "Reaction once a voice message has been transcribed (empty to remove the reaction)")
+var reactError = flag.String("react-error", "❌", "Reaction in case a voice message could not be transcribed")
+var sendRate = flag.Int("send-rate", 0, "Maximum number of messages to send per minute, further messages wait their turn (0 for no limit)")
+var sendRetries = flag.Int("send-retries", 3, "Number of retries with increasing delay in case sending a message fails due to a timeout, the connection or a rate limit")
+var noReply = flag.Bool("no-reply", false, "Never send anything to WhatsApp, only log the transcripts")
+var shortThreshold = flag.Int("short-threshold", 0, "Transcripts shorter than this many characters are delivered in short form (0 disables)")
+var shortAsReaction = flag.Bool("short-as-reaction", false, "Deliver short transcripts as a reaction instead of a short inline reply")
 
 func main() {
 	waBinary.IndentXML = true
 	flag.Parse()
+	// precedence: command line, config file, environment, default
+	if value, ok := lookupEnv("config"); ok && !isFlagSet("config") {
+		flag.Set("config", value)
+	}
+	if *configFile != "" {
+		err := loadConfig(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read configuration: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	expandFlagsFromEnv()
+	err := loadEnvironment()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read configuration from the environment: %v\n", err)
+		os.Exit(2)
+	}
+	storeSettings()
 
 	if *debugLogs {
 		logLevel = "DEBUG"
 	}
-	if *apiKey == "" {
-		*apiKey = os.Getenv("API_KEY")
-	}
 	store.DeviceProps.RequireFullSync = proto.Bool(false)
 	store.DeviceProps.HistorySyncConfig = &waProto.DeviceProps_HistorySyncConfig{
 		FullSyncDaysLimit:   proto.Uint32(0),
@@ -65,28 +305,282 @@ func main() {
 		StorageQuotaMb:      proto.Uint32(0),
 	}
 	log = waLog.Stdout("Main", logLevel, true)
+	for _, reaction := range []string{*reactStart, *reactDone, *reactError} {
+		if reaction != "" && !isSingleEmoji(reaction) {
+			log.Errorf("Reaction %q is not a single emoji", reaction)
+			return
+		}
+	}
+	if name := strings.TrimSpace(*deviceName); name == "" || strings.ContainsAny(name, "\r\n") || utf8.RuneCountInString(name) > maxDeviceNameLength {
+		log.Errorf("Device name must be a single line of 1 to %d characters", maxDeviceNameLength)
+		return
+	}
+	if *thread != "each" && *thread != "first" && *thread != "none" {
+		log.Errorf("Unknown threading %q, must be \"each\", \"first\" or \"none\"", *thread)
+		return
+	}
+	if *transcribeQuoted && !*dedup {
+		log.Errorf("Transcribing quoted voice messages needs dedup, or each reply would transcribe them again")
+		return
+	}
+	if *readingWPM <= 0 {
+		log.Errorf("Words per minute must be positive")
+		return
+	}
+	if *stripAnnotationsFlag {
+		annotations, err = regexp.Compile(*annotationPattern)
+		if err != nil {
+			log.Errorf("Invalid annotation pattern: %v", err)
+			return
+		}
+	}
+	if *transcriptDir != "" {
+		err = validateFilenameTemplate(*transcriptFilenameTemplate)
+		if err != nil {
+			log.Errorf("Invalid transcript file name: %v", err)
+			return
+		}
+	}
+	if *debugSaveResponses != "" {
+		err = os.MkdirAll(*debugSaveResponses, 0700)
+		if err != nil {
+			log.Errorf("Failed to create directory for saving responses: %v", err)
+			return
+		}
+	}
+	if *unsupportedFormatPattern != "" {
+		unsupportedFormat, err = regexp.Compile(*unsupportedFormatPattern)
+		if err != nil {
+			log.Errorf("Invalid unsupported format pattern: %v", err)
+			return
+		}
+	}
+	if *asCaption {
+		log.Infof("Voice messages cannot have a caption, they will still be replied to. Only your own audio documents get their transcript as caption.")
+	}
+	httpClient, err = newHTTPClient(*tlsMinVersion)
+	if err != nil {
+		log.Errorf("Failed to set up transcription: %v", err)
+		return
+	}
+	transcriber, err = newTranscriber(*backend)
+	if err != nil {
+		log.Errorf("Failed to set up transcription: %v", err)
+		return
+	}
+	for _, entry := range splitList(*chatBackends) {
+		_, name, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			log.Errorf("Invalid entry %q in the chat backends, must be chat=backend", entry)
+			return
+		}
+		if name == *backend || chatTranscribers[name] != nil {
+			continue
+		}
+		chatTranscribers[name], err = newTranscriber(name)
+		if err != nil {
+			log.Errorf("Failed to set up transcription with %s: %v", name, err)
+			return
+		}
+	}
+	if *breakerFailures > 0 {
+		// each backend fails on its own
+		breakers = map[string]*circuitBreaker{*backend: newCircuitBreaker(*backend, *breakerFailures, *breakerCooldown)}
+		for name := range chatTranscribers {
+			breakers[name] = newCircuitBreaker(name, *breakerFailures, *breakerCooldown)
+		}
+	}
+	transcriptionTimeout = *httpTimeout
+	if transcriptionTimeout <= 0 {
+		transcriptionTimeout = defaultTimeout(*backend)
+	}
+	if *cleanup {
+		cleaner = &Cleaner{URL: *cleanupURL, Model: *cleanupModel, Prompt: *cleanupPrompt, Key: newAPIKey(*apiKeyFlag)}
+		if openAI, ok := transcriber.(*OpenAITranscriber); ok {
+			cleaner.Key = openAI.Key
+		}
+	}
+	if *batchDir != "" {
+		err = runBatch(*batchDir)
+		if err != nil {
+			log.Errorf("Batch transcription failed: %v", err)
+		}
+		return
+	}
+	queue = newChatQueue(runCtx, *concurrency, *dispatchJitter, *queueSize)
+	if *downloadConcurrency > 0 {
+		downloadSlots = make(chan struct{}, *downloadConcurrency)
+	}
+	if *forwardTo != "" {
+		forwardChat, err = types.ParseJID(*forwardTo)
+		if err != nil {
+			log.Errorf("Invalid chat to forward to: %v", err)
+			return
+		}
+	}
+	if *adminJID != "" {
+		adminChat, err = types.ParseJID(*adminJID)
+		if err != nil {
+			log.Errorf("Invalid admin chat: %v", err)
+			return
+		}
+	}
+	if *alertFactor > 0 {
+		volume = newVolumeMonitor(*alertFactor, func(metric string, value, average float64) {
+			log.Warnf("Unusual transcription volume: %s is at %.0f this hour, the average is %.1f.", metric, value, average)
+			emitAlert(AlertEvent{
+				SchemaVersion: transcriptSchemaVersion,
+				Type:          "alert",
+				Timestamp:     time.Now(),
+				Metric:        metric,
+				Value:         value,
+				Average:       average,
+			})
+		})
+	}
+	if *sendRate > 0 {
+		pacer = newSendPacer(*sendRate)
+	}
+	if *memoryBudgetMB > 0 {
+		budget = newMemoryBudget(int64(*memoryBudgetMB) << 20)
+	}
+	if *quietStart != "" || *quietEnd != "" {
+		quiet, err = newQuietHours(*quietStart, *quietEnd, *quietTimezone)
+		if err != nil {
+			log.Errorf("%v", err)
+			return
+		}
+	}
+	if *chatReplyRate > 0 {
+		replyLimiter = newChatRateLimiter(*chatReplyRate, time.Minute, func(chat types.JID, skipped int) {
+			if !canReply(chat) {
+				return
+			}
+			msg := &waProto.Message{Conversation: proto.String(fmt.Sprintf("(rate limited, %d notes skipped)", skipped))}
+			if err := sendMessage(context.Background(), chat, msg); err != nil {
+				log.Warnf("Failed to tell %s about skipped voice messages: %v", redactJID(chat), err)
+			}
+		})
+	}
 
-	store.DeviceProps.Os = proto.String("whatsmeow-transcribe")
+	store.DeviceProps.Os = proto.String(*deviceName)
+	if *devicePlatform != "" {
+		platform, ok := waCompanionReg.DeviceProps_PlatformType_value[strings.ToUpper(*devicePlatform)]
+		if !ok {
+			log.Errorf("Unknown device platform %q", *devicePlatform)
+			return
+		}
+		store.DeviceProps.PlatformType = waProto.DeviceProps_PlatformType(platform).Enum()
+	}
 
 	dbLog := waLog.Stdout("Database", logLevel, true)
-	storeContainer, err := sqlstore.New(*dbDialect, *dbAddress, dbLog)
+	db, err = sql.Open(*dbDialect, *dbAddress)
 	if err != nil {
 		log.Errorf("Failed to connect to database: %v", err)
 		return
 	}
+	storeContainer = sqlstore.NewWithDB(db, *dbDialect, dbLog)
+	err = storeContainer.Upgrade()
+	if err != nil {
+		log.Errorf("Failed to upgrade database: %v", err)
+		return
+	}
+	err = upgradeDB()
+	if err != nil {
+		log.Errorf("Failed to upgrade database: %v", err)
+		return
+	}
+	if *exportChat != "" {
+		chat, err := types.ParseJID(*exportChat)
+		if err != nil {
+			log.Errorf("Invalid chat to export: %v", err)
+			return
+		}
+		err = exportTranscripts(chat, *exportSince, *exportUntil, *exportFile)
+		if err != nil {
+			log.Errorf("Export failed: %v", err)
+		}
+		return
+	}
+	if *serveTranscribeAddr != "" {
+		go serveTranscribe(*serveTranscribeAddr)
+	}
+	if *dbMaintenanceInterval > 0 {
+		go maintainDB(*dbMaintenanceInterval)
+	}
 	device, err := storeContainer.GetFirstDevice()
 	if err != nil {
 		log.Errorf("Failed to get device: %v", err)
 		return
 	}
 
-	cli = whatsmeow.NewClient(device, waLog.Stdout("Client", logLevel, true))
-	cli.PrePairCallback = func(jid types.JID, platform, businessName string) bool {
-		log.Infof("Pairing %s (platform: %q, business name: %q).", jid, platform, businessName)
+	activeClient.Store(newClient(device))
+	messenger, downloader = liveClient{}, liveClient{}
+	if *noQR {
+		if device.ID == nil {
+			log.Errorf("Device is not paired and QR code pairing is disabled")
+			return
+		}
+	} else {
+		startQR()
+	}
+
+	err = client().Connect()
+	if err != nil {
+		log.Errorf("Failed to connect: %v", err)
+		return
+	}
+
+	go handlePauseSignals()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-hup:
+			if *configFile == "" {
+				log.Infof("Hangup received, but there is no configuration file to reload")
+				continue
+			}
+			reloadConfig(*configFile)
+		case <-c:
+			log.Infof("Interrupt received, exiting")
+			if *shutdownTimeout > 0 {
+				log.Infof("Waiting up to %s for transcriptions in progress.", *shutdownTimeout)
+				if !queue.Drain(*shutdownTimeout) {
+					log.Warnf("Transcriptions still in progress after %s, cancelling them.", *shutdownTimeout)
+				}
+			}
+			stopRunning()
+			client().Disconnect()
+			return
+		case <-quitter:
+			log.Infof("Shutdown requested, exiting")
+			stopRunning()
+			if exitCode != 0 {
+				os.Exit(exitCode)
+			}
+			return
+		}
+	}
+}
+
+func newClient(device *store.Device) *whatsmeow.Client {
+	client := whatsmeow.NewClient(device, waLog.Stdout("Client", logLevel, true))
+	client.PrePairCallback = func(jid types.JID, platform, businessName string) bool {
+		log.Infof("Pairing %s (platform: %q, business name: %q).", redactJID(jid), platform, redactName(businessName))
 		return true
 	}
+	client.AddEventHandler(handler)
+	client.AutoReconnectHook = reconnectHook
+	return client
+}
 
-	ch, err := cli.GetQRChannel(context.Background())
+// startQR shows QR codes for pairing in case the device is not paired yet.
+func startQR() {
+	ch, err := client().GetQRChannel(context.Background())
 	if err != nil {
 		// This error means that we're already logged in, so ignore it.
 		if !errors.Is(err, whatsmeow.ErrQRStoreContainsID) {
@@ -103,36 +597,95 @@ func main() {
 			}
 		}()
 	}
+}
 
-	cli.AddEventHandler(handler)
-	err = cli.Connect()
+// relogin replaces the logged out device with a new one and offers pairing by QR code again.
+func relogin() {
+	client().Disconnect()
+	activeClient.Store(newClient(storeContainer.NewDevice()))
+	startQR()
+	err := client().Connect()
 	if err != nil {
 		log.Errorf("Failed to connect: %v", err)
-		return
+		quit(1)
 	}
+}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	for {
-		select {
-		case <-c:
-			log.Infof("Interrupt received, exiting")
-			cli.Disconnect()
-			return
-		case <-quitter:
-			log.Infof("Shutdown requested, exiting")
-			return
+// expandFlagsFromEnv replaces references to environment variables like ${API_KEY}
+// in all flag values which have been set on the command line.
+// A literal $ can be written as $$.
+func expandFlagsFromEnv() {
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		expanded := os.Expand(value, expandEnv)
+		if expanded != value {
+			f.Value.Set(expanded)
 		}
+	})
+}
+
+func expandEnv(name string) string {
+	if name == "$" {
+		return "$"
 	}
+	return os.Getenv(name)
+}
+
+// isFlagSet reports whether the flag has been set explicitly, on the command line, in the config file or the environment.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func handler(rawEvt interface{}) {
 	switch evt := rawEvt.(type) {
-	case *events.StreamReplaced, *events.Disconnected:
+	case *events.Connected:
+		if connectedAt.IsZero() {
+			connectedAt = time.Now()
+			if *startupGrace > 0 {
+				log.Infof("Ignoring voice messages for %s while the client settles.", *startupGrace)
+				time.AfterFunc(*startupGrace, func() { log.Infof("Startup grace period is over, processing voice messages.") })
+			}
+			if *durableQueue {
+				go resumeJobs()
+			}
+			if *retryDeadLettersFlag {
+				go retryDeadLetters()
+			}
+		}
+		onReconnected()
+	case *events.LoggedOut:
+		if *reloginFlag && !*noQR {
+			log.Warnf("Logged out (%s). Offering to pair again.", evt.Reason)
+			go relogin()
+		} else {
+			log.Warnf("Logged out (%s).", evt.Reason)
+		}
+	case *events.Disconnected:
+		if reconnectEnabled() {
+			log.Warnf("Disconnected, reconnecting.")
+			onDisconnected()
+			return
+		}
 		log.Infof("Got %+v. Terminating.", evt)
-		close(quitter)
+		quit(0)
+	case *events.Receipt:
+		// played by this account on another device, or a voice message sent by this account played by the recipient
+		if evt.Type == types.ReceiptTypePlayedSelf || (evt.Type == types.ReceiptTypePlayed && !evt.IsGroup) {
+			for _, id := range evt.MessageIDs {
+				playedMessages.Add(id)
+			}
+		}
+	case *events.StreamReplaced:
+		log.Infof("Got %+v. Terminating.", evt)
+		quit(0)
 	case *events.Message:
-		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
+		metaParts := []string{fmt.Sprintf("pushname: %s", redactName(evt.Info.PushName)), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
 			metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
 		}
@@ -155,85 +708,1095 @@ func handler(rawEvt interface{}) {
 			metaParts = append(metaParts, "edit")
 		}
 
-		log.Infof("Received message %s from %s (%s).", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "))
+		log.Infof("Received message %s from %s (%s).", evt.Info.ID, redactSource(evt.Info.MessageSource), strings.Join(metaParts, ", "))
 
-		am := evt.Message.GetAudioMessage()
-		if am != nil {
-			audio_data, err := cli.Download(am)
-			if err != nil {
-				log.Errorf("Failed to download audio: %v", err)
-				return
-			}
-			if am.GetPTT() {
-				maybeText := getTranscription(audio_data)
-				if maybeText != nil {
-					text := *maybeText
-					msg := &waProto.Message{
-						ExtendedTextMessage: &waProto.ExtendedTextMessage{
-							Text: proto.String(*messageHead + text),
-							ContextInfo: &waProto.ContextInfo{
-								StanzaID:      proto.String(evt.Info.ID),
-								Participant:   proto.String(evt.Info.Sender.ToNonAD().String()),
-								QuotedMessage: evt.Message,
-							},
-						},
-					}
-					_, _ = cli.SendMessage(context.Background(), evt.Info.MessageSource.Chat, msg)
+		if evt.Info.IsFromMe && sentMessages.Contains(evt.Info.ID) {
+			log.Debugf("Ignoring message %s sent by this program.", evt.Info.ID)
+			return
+		}
+		trackRun(evt)
+
+		if *onMention && evt.Info.IsGroup {
+			if quotedEvt := mentionedAudio(evt); quotedEvt != nil {
+				if *revokeCommandFlag {
+					rememberCommand(quotedEvt, evt)
 				}
+				enqueueAudio(quotedEvt, findAudio(quotedEvt.Message))
 			}
+			return
+		}
+		if *transcribeQuoted {
+			if quotedEvt := quotedAudio(evt); quotedEvt != nil {
+				log.Debugf("Message %s replies to voice message %s.", evt.Info.ID, quotedEvt.Info.ID)
+				enqueueAudio(quotedEvt, findAudio(quotedEvt.Message))
+			}
+		}
+		if media := findAudio(evt.Message); len(media) > 0 {
+			enqueueAudio(evt, media)
+		} else if editEvt := editedAudio(evt); settings().transcribeEdits && editEvt != nil {
+			// the original has been handled already, but its audio changed
+			releaseMessage(editEvt.Info.Chat, editEvt.Info.ID)
+			enqueueAudio(editEvt, findAudio(editEvt.Message))
 		}
 	}
 }
 
-// TODO: return error, log in caller
-func getTranscription(audio_data []byte) *string {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	writer.WriteField("model", "whisper-1")
-	writer.WriteField("response_format", "text")
-	part, err := writer.CreateFormFile("file", "ptt.oga")
-	if err != nil {
-		log.Warnf("Transcription: Error creating form file: %#v", err)
+// editedAudio returns a message event for the edited message in case the edit contains audio, nil otherwise.
+// The event carries the ID of the original message, so the transcript replies to it.
+func editedAudio(evt *events.Message) *events.Message {
+	protocolMessage := evt.Message.GetProtocolMessage()
+	if protocolMessage.GetType() != waProto.ProtocolMessage_MESSAGE_EDIT || len(findAudio(protocolMessage.GetEditedMessage())) == 0 {
 		return nil
 	}
-	_, err = part.Write(audio_data)
-	if err != nil {
-		log.Warnf("Transcription: Error writing data into part: %#v", err)
+	editEvt := *evt
+	editEvt.Info.ID = protocolMessage.GetKey().GetID()
+	editEvt.Message = protocolMessage.GetEditedMessage()
+	return &editEvt
+}
+
+// enqueueAudio schedules the audio in the message for transcription unless it is to be ignored.
+func enqueueAudio(evt *events.Message, media []whatsmeow.DownloadableMessage) {
+	if paused.Load() {
+		log.Infof("Ignoring audio in message %s, transcription is paused.", evt.Info.ID)
+		return
+	}
+	if !isAllowedCategory(evt.Info.Category) {
+		log.Debugf("Ignoring audio in message %s of category %q which is not allowed.", evt.Info.ID, evt.Info.Category)
+		return
+	}
+	if isLimitReached() {
+		log.Infof("Ignoring audio in message %s, the limit of transcriptions has been reached.", evt.Info.ID)
+		return
+	}
+	if isStatus(evt) && !*transcribeStatus {
+		log.Infof("Ignoring audio in status update %s.", evt.Info.ID)
+		return
+	}
+	if isNewsletter(evt) && !*transcribeNewsletters {
+		log.Infof("Ignoring audio in channel message %s.", evt.Info.ID)
+		return
+	}
+	if settings().skipForwarded && isForwarded(evt.Message) {
+		log.Infof("Ignoring forwarded audio in message %s.", evt.Info.ID)
+		return
+	}
+	if settings().skipCaptioned && strings.TrimSpace(unwrapMessage(evt.Message).GetDocumentMessage().GetCaption()) != "" {
+		log.Infof("Ignoring audio document in message %s which has a caption.", evt.Info.ID)
+		return
+	}
+	if *selfChatOnly && !evt.Info.IsFromMe {
+		log.Infof("Ignoring audio in message %s not sent by this account.", evt.Info.ID)
+		return
+	}
+	var allowed []whatsmeow.DownloadableMessage
+	for _, part := range media {
+		if mimetype := audioMimetype(part); !isAllowedMimetype(mimetype) {
+			log.Debugf("Ignoring audio in message %s with mimetype %q which is not allowed.", evt.Info.ID, mimetype)
+			continue
+		}
+		allowed = append(allowed, part)
+	}
+	if len(allowed) == 0 {
+		return
+	}
+	media = allowed
+	if time.Now().Before(connectedAt.Add(*startupGrace)) {
+		log.Infof("Ignoring audio in message %s received during the startup grace period.", evt.Info.ID)
+		return
+	}
+	// the time of a quoted voice message is unknown, it is transcribed due to a recent reply
+	if *skipHistory && (connectedAt.IsZero() || (!evt.Info.Timestamp.IsZero() && evt.Info.Timestamp.Before(connectedAt))) {
+		log.Infof("Ignoring audio in message %s sent before connecting at %s.", evt.Info.ID, connectedAt)
+		return
+	}
+	if *dedup {
+		claimed, err := claimMessage(evt.Info.Chat, evt.Info.ID)
+		if err != nil {
+			log.Warnf("Failed to check whether message %s has been handled before: %v", evt.Info.ID, err)
+		} else if !claimed {
+			log.Infof("Ignoring message %s which has been handled before.", evt.Info.ID)
+			return
+		}
+	}
+	var speech []whatsmeow.DownloadableMessage
+	for _, part := range media {
+		if isLikelyMusic(part) {
+			log.Infof("Not transcribing audio in message %s which is likely music.", evt.Info.ID)
+			continue
+		}
+		speech = append(speech, part)
+	}
+	if len(speech) == 0 {
+		if *musicMessage != "" {
+			sendReply(context.Background(), evt, *musicMessage)
+		}
+		return
+	}
+	media = speech
+	if *durableQueue {
+		err := saveJob(evt)
+		if err != nil {
+			log.Warnf("Failed to save job of message %s: %v", evt.Info.ID, err)
+		}
+	}
+	if *skipPlayed && *skipPlayedWait > 0 {
+		// give other devices the chance to report that the voice message has been played
+		time.AfterFunc(*skipPlayedWait, func() { queueAudio(evt, media) })
+		return
+	}
+	queueAudio(evt, media)
+}
+
+// queueAudio has the audio processed in the background. Replies within one chat keep their order.
+// In case the queue is full, the voice message is rejected.
+func queueAudio(evt *events.Message, media []whatsmeow.DownloadableMessage) {
+	err := queue.Enqueue(evt.Info.Chat, func() func() {
+		reply := handleAudio(evt, media)
+		if !*durableQueue {
+			return reply
+		}
+		return func() {
+			if reply != nil {
+				reply()
+			}
+			deleteJob(evt.Info.Chat, evt.Info.ID)
+		}
+	})
+	if !errors.Is(err, ErrQueueFull) {
+		return
+	}
+	rejectedCount.Add(1)
+	log.Warnf("Rejecting audio in message %s, %d voice messages are waiting already.", evt.Info.ID, queue.Depth())
+	if *dedup {
+		// the reply invites to try again
+		releaseMessage(evt.Info.Chat, evt.Info.ID)
+	}
+	if *durableQueue {
+		deleteJob(evt.Info.Chat, evt.Info.ID)
+	}
+	if *deadLetters {
+		saveDeadLetter(evt, err, 0)
+	}
+	if *queueFullMessage != "" {
+		sendReply(context.Background(), evt, *queueFullMessage)
+	}
+}
+
+// mentionedAudio checks whether the message mentions this account and replies to a voice message.
+// If so, it returns a message event for the voice message replied to.
+func mentionedAudio(evt *events.Message) *events.Message {
+	quotedEvt := quotedAudio(evt)
+	if quotedEvt == nil {
 		return nil
 	}
-	err = writer.Close()
-	if err != nil {
-		log.Warnf("Transcription: Error closing writer: %#v", err)
+	for _, jid := range getContextInfo(evt.Message).GetMentionedJID() {
+		if jid == client().Store.ID.ToNonAD().String() {
+			return quotedEvt
+		}
+	}
+	return nil
+}
+
+// quotedAudio checks whether the message replies to a voice message.
+// If so, it returns a message event for the voice message replied to.
+func quotedAudio(evt *events.Message) *events.Message {
+	contextInfo := getContextInfo(evt.Message)
+	if contextInfo.GetQuotedMessage() == nil || len(findAudio(contextInfo.GetQuotedMessage())) == 0 {
 		return nil
 	}
-	req, err := http.NewRequest("POST", *apiUrl, body)
+	sender := evt.Info.Chat
+	if contextInfo.GetParticipant() != "" || evt.Info.IsGroup {
+		var err error
+		sender, err = types.ParseJID(contextInfo.GetParticipant())
+		if err != nil {
+			log.Warnf("Failed to parse sender of quoted message %s: %v", contextInfo.GetStanzaID(), err)
+			return nil
+		}
+	}
+	quotedEvt := &events.Message{Info: evt.Info, Message: contextInfo.GetQuotedMessage()}
+	quotedEvt.Info.ID = contextInfo.GetStanzaID()
+	quotedEvt.Info.Sender = sender
+	quotedEvt.Info.IsFromMe = sender.User == client().Store.ID.User
+	// the quote tells neither when the voice message was sent nor the name of its sender
+	quotedEvt.Info.Timestamp = time.Time{}
+	quotedEvt.Info.PushName = pushName(sender)
+	return quotedEvt
+}
+
+// pushName returns the name the user has chosen for themselves as last seen by this account, empty if unknown.
+func pushName(user types.JID) string {
+	c := client()
+	if user.User == c.Store.ID.User {
+		return c.Store.PushName
+	}
+	contact, err := c.Store.Contacts.GetContact(user.ToNonAD())
 	if err != nil {
-		log.Warnf("Transcription: Error creating request: %#v", err)
+		log.Warnf("Failed to get contact %s: %v", redactJID(user), err)
+		return ""
+	}
+	return contact.PushName
+}
+
+// getContextInfo returns the context info (replies, mentions, forwarding) of a message.
+func getContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	msg = unwrapMessage(msg)
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		return msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetContextInfo()
+	default:
 		return nil
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", *apiKey))
+}
 
-	// Send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Warnf("Transcription: Error sending request: %#v", err)
+// isLimitReached reports whether the maximum number of transcriptions has been reached.
+func isLimitReached() bool {
+	return *maxMessages > 0 && transcribedCount.Load() >= int64(*maxMessages)
+}
+
+// isStatus reports whether the message is a status update rather than a message in a chat.
+func isStatus(evt *events.Message) bool {
+	return evt.Info.Chat == types.StatusBroadcastJID
+}
+
+// isNewsletter reports whether the message was posted in a channel (formerly called newsletter).
+func isNewsletter(evt *events.Message) bool {
+	return evt.Info.Chat.Server == types.NewsletterServer
+}
+
+// isForwarded reports whether the message was forwarded from another chat.
+func isForwarded(msg *waProto.Message) bool {
+	return getContextInfo(msg).GetIsForwarded()
+}
+
+// head returns the text to start the transcript of the message with.
+func head(evt *events.Message) string {
+	s := settings()
+	if s.forwardedMessageHead != "" && isForwarded(evt.Message) {
+		return s.forwardedMessageHead
+	}
+	return s.messageHead
+}
+
+// unwrapMessage returns the message contained in wrappers not handled by the WhatsApp library,
+// like the one used for view once voice messages. Wrappers may be nested.
+// Note that albums do not wrap their media, each item arrives as a message of its own.
+func unwrapMessage(msg *waProto.Message) *waProto.Message {
+	for depth := 0; depth < 5; depth++ {
+		var inner *waProto.Message
+		switch {
+		case msg.GetViewOnceMessageV2Extension().GetMessage() != nil:
+			inner = msg.GetViewOnceMessageV2Extension().GetMessage()
+		case msg.GetGroupMentionedMessage().GetMessage() != nil:
+			inner = msg.GetGroupMentionedMessage().GetMessage()
+		case msg.GetBotInvokeMessage().GetMessage() != nil:
+			inner = msg.GetBotInvokeMessage().GetMessage()
+		case msg.GetEphemeralMessage().GetMessage() != nil:
+			inner = msg.GetEphemeralMessage().GetMessage()
+		case msg.GetViewOnceMessage().GetMessage() != nil:
+			inner = msg.GetViewOnceMessage().GetMessage()
+		case msg.GetViewOnceMessageV2().GetMessage() != nil:
+			inner = msg.GetViewOnceMessageV2().GetMessage()
+		case msg.GetDocumentWithCaptionMessage().GetMessage() != nil:
+			inner = msg.GetDocumentWithCaptionMessage().GetMessage()
+		default:
+			return msg
+		}
+		msg = inner
+	}
+	return msg
+}
+
+// replyText returns the complete text of the reply with the transcript.
+// A structured reply is complete already.
+func replyText(evt *events.Message, text string) string {
+	if *structuredReply {
+		return text
+	}
+	stats := ""
+	if *showStats {
+		words := len(strings.Fields(text))
+		minutes := max((words+*readingWPM-1) / *readingWPM, 1)
+		stats = fmt.Sprintf("(%d words, ~%d min read)\n", words, minutes)
+	}
+	return stats + head(evt) + text + settings().messageFoot
+}
+
+// findAudio returns the audio contained in the message, the voice recording first.
+// The contents of a message are not exclusive, so an audio and an audio document may come together.
+func findAudio(msg *waProto.Message) []whatsmeow.DownloadableMessage {
+	msg = unwrapMessage(msg)
+	var media []whatsmeow.DownloadableMessage
+	if am := msg.GetAudioMessage(); am.GetPTT() || (am != nil && *transcribeAllAudio) {
+		media = append(media, am)
+	}
+	if dm := msg.GetDocumentMessage(); *transcribeAudioDocuments && strings.HasPrefix(dm.GetMimetype(), "audio/") {
+		media = append(media, dm)
+	}
+	return media
+}
+
+// joinTranscripts combines the transcripts of the audio in the message into one.
+func joinTranscripts(media []whatsmeow.DownloadableMessage, parts []Transcript) Transcript {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	joined := Transcript{Backend: parts[0].Backend}
+	texts := make([]string, len(parts))
+	for i, part := range parts {
+		texts[i] = part.Text
+		if joined.Language == "" {
+			joined.Language = part.Language
+		}
+		if part.Confidence > 0 && (joined.Confidence == 0 || part.Confidence < joined.Confidence) {
+			joined.Confidence = part.Confidence
+		}
+		joined.Retries += part.Retries
+	}
+	joined.Text = labelParts(media, texts)
+	return joined
+}
+
+// labelParts joins the texts of the audio in the message, each one in a section of its own.
+func labelParts(media []whatsmeow.DownloadableMessage, texts []string) string {
+	if len(texts) == 1 {
+		return texts[0]
+	}
+	sections := make([]string, len(texts))
+	for i, text := range texts {
+		label := fmt.Sprintf("Audio %d of %d", i+1, len(texts))
+		if name := unwrapDocument(media[i]).GetFileName(); name != "" {
+			label += " (" + name + ")"
+		}
+		sections[i] = label + ":\n" + text
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// unwrapDocument returns the media as document, nil if it is not one.
+func unwrapDocument(media whatsmeow.DownloadableMessage) *waProto.DocumentMessage {
+	dm, _ := media.(*waProto.DocumentMessage)
+	return dm
+}
+
+// totalSeconds returns the duration of all audio as announced by the sender, zero if unknown.
+func totalSeconds(media []whatsmeow.DownloadableMessage) uint32 {
+	var seconds uint32
+	for _, part := range media {
+		seconds += audioSeconds(part)
+	}
+	return seconds
+}
+
+// handleAudio downloads and transcribes the audio in the message.
+// It returns a function to reply with the transcript, nil if there is nothing to reply.
+func handleAudio(evt *events.Message, media []whatsmeow.DownloadableMessage) (reply func()) {
+	ctx := withMessageID(withRequestID(runCtx, newRequestID()), evt.Info.ID)
+	l := loggerFor(ctx)
+	if isLimitReached() {
+		l.Infof("Skipping message %s, the limit of transcriptions has been reached.", evt.Info.ID)
+		if *dedup {
+			releaseMessage(evt.Info.Chat, evt.Info.ID)
+		}
+		return nil
+	}
+	if *skipPlayed && playedMessages.Contains(evt.Info.ID) {
+		l.Infof("Skipping message %s which has been played already.", evt.Info.ID)
+		return nil
+	}
+	if replyLimiter != nil && !replyLimiter.Allow(evt.Info.Chat) {
+		l.Infof("Skipping message %s, too many replies to %s recently.", evt.Info.ID, redactJID(evt.Info.Chat))
+		if *dedup {
+			releaseMessage(evt.Info.Chat, evt.Info.ID)
+		}
+		return nil
+	}
+	if budget != nil {
+		// the audio is held twice, once as downloaded and once in the request, unless the request is streamed
+		var size int64
+		for _, part := range media {
+			size += audioSize(part)
+		}
+		if !*streamMedia {
+			size *= 2
+		}
+		taken, err := budget.Acquire(runCtx, size)
+		if err != nil {
+			if *dedup {
+				releaseMessage(evt.Info.Chat, evt.Info.ID)
+			}
+			return nil
+		}
+		defer budget.Release(taken)
+	}
+	react(ctx, evt, *reactStart)
+	var partial *partialReply
+	if len(media) == 1 && *streamFlag && settings().replyDelay == 0 && !*selfChatOnly && !*structuredReply && !isStatus(evt) && !isNewsletter(evt) && (quiet == nil || !quiet.Active(time.Now())) {
+		partial = &partialReply{ctx: ctx, evt: evt}
+		defer func() {
+			if reply == nil {
+				partial.Discard()
+			}
+		}()
+	}
+	parts := make([]Transcript, len(media))
+	data := make([][]byte, len(media))
+	var latency time.Duration
+	for i, part := range media {
+		var took time.Duration
+		var ok bool
+		parts[i], data[i], took, ok = transcribePart(ctx, evt, part, partial)
+		if !ok {
+			return nil
+		}
+		latency += took
+	}
+	transcript := joinTranscripts(media, parts)
+	seconds := totalSeconds(media)
+	if *storeTranscripts {
+		storeTranscript(evt, seconds, transcript, latency)
+	}
+	if *transcriptDir != "" {
+		writeTranscriptFile(evt, transcript.Text)
+	}
+	event := newTranscriptEvent(ctx, evt, seconds, transcript, latency)
+	emit(event)
+	if volume != nil {
+		volume.Record(time.Now(), seconds)
+	}
+	count := transcribedCount.Add(1)
+	if *maxMessages > 0 && count == int64(*maxMessages) {
+		l.Warnf("Transcribed %d voice messages, which is the limit. Further voice messages are ignored.", *maxMessages)
+		if *maxMessagesExit {
+			quit(0)
+		}
+	}
+	if !isWantedLanguage(transcript.Language) {
+		l.Infof("Not replying to message %s in unwanted language %q.", evt.Info.ID, transcript.Language)
+		react(ctx, evt, "")
+		return nil
+	}
+	texts := make([]string, len(parts))
+	stripped, spoken := true, false
+	for i, part := range parts {
+		texts[i] = part.Text
+		if annotations != nil {
+			texts[i] = stripAnnotations(part.Text)
+		}
+		stripped = stripped && texts[i] == ""
+		spoken = spoken || strings.TrimSpace(part.Text) != ""
+	}
+	if annotations != nil && stripped && spoken {
+		l.Infof("Transcript of message %s consists of annotations only, not replying.", evt.Info.ID)
+		react(ctx, evt, "")
 		return nil
 	}
-	defer resp.Body.Close()
+	text := labelParts(media, texts)
+	if cleaner != nil && text != "" {
+		cleaned, err := cleaner.Clean(ctx, text)
+		if err != nil {
+			l.Warnf("Failed to clean up transcript of message %s, replying with the verbatim transcript: %v", evt.Info.ID, err)
+		} else if *cleanupKeepRaw {
+			text = cleaned + "\n\nVerbatim:\n> " + text
+		} else {
+			text = cleaned
+		}
+	}
+	if settings().truncateLength > 0 {
+		text = truncate(text, settings().truncateLength)
+	}
+	if *lowConfidence > 0 && transcript.Confidence > 0 && transcript.Confidence < *lowConfidence {
+		l.Infof("Confidence of the transcript of message %s is low (%.2f).", evt.Info.ID, transcript.Confidence)
+		if !*structuredReply {
+			text += "\n" + *lowConfidenceMarker
+		}
+	}
+	if *showDuration && !*structuredReply {
+		var duration float64
+		for i, part := range media {
+			partSeconds := float64(audioSeconds(part))
+			if partSeconds == 0 {
+				var err error
+				partSeconds, err = probeDuration(ctx, data[i])
+				if err != nil {
+					l.Debugf("Failed to determine the duration of message %s: %v", evt.Info.ID, err)
+				}
+			}
+			duration += partSeconds
+		}
+		if duration > 0 {
+			text = "🎙️ " + formatDuration(time.Duration(duration*float64(time.Second))) + "\n" + text
+		}
+	}
+	if *structuredReply {
+		event.Text = text
+		text = structuredReplyText(event)
+	}
+	if *noReply {
+		l.Infof("Transcript of message %s: %s", evt.Info.ID, text)
+	}
+	if isStatus(evt) {
+		// status updates cannot be replied to in a standard way
+		l.Infof("Transcript of status update %s: %s", evt.Info.ID, text)
+		if !forwardChat.IsEmpty() {
+			forwardTranscript(ctx, evt, text)
+		}
+		return nil
+	}
+	if isNewsletter(evt) {
+		// only the owner and admins of a channel can post in it
+		l.Infof("Transcript of channel message %s: %s", evt.Info.ID, text)
+		if !forwardChat.IsEmpty() {
+			forwardTranscript(ctx, evt, text)
+		}
+		return nil
+	}
+	return func() {
+		if partial != nil && partial.Finish(text) {
+			if !forwardChat.IsEmpty() {
+				forwardTranscript(ctx, evt, text)
+			}
+			revokeCommand(ctx, evt)
+			react(ctx, evt, *reactDone)
+			return
+		}
+		if settings().replyDelay > 0 {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-time.After(settings().replyDelay):
+			}
+		}
+		send := func() {
+			sendTranscript(ctx, evt, text)
+			if !forwardChat.IsEmpty() {
+				forwardTranscript(ctx, evt, text)
+			}
+			revokeCommand(ctx, evt)
+			if !isReaction(text) {
+				react(ctx, evt, *reactDone)
+			}
+		}
+		if quiet != nil && quiet.Active(time.Now()) {
+			if settings().quietDrop {
+				l.Infof("Not replying to message %s during quiet hours.", evt.Info.ID)
+				return
+			}
+			quiet.Hold(send)
+			return
+		}
+		send()
+	}
+}
 
-	// Print the response
-	log.Infof("Transcription: Response status: %#v", resp.Status)
+// transcribePart downloads and transcribes one audio of the message.
+// It returns the transcript, the audio and how long the transcription took.
+// In case this fails, the failure has been reported already and false is returned.
+func transcribePart(ctx context.Context, evt *events.Message, media whatsmeow.DownloadableMessage, partial *partialReply) (Transcript, []byte, time.Duration, bool) {
+	l := loggerFor(ctx)
+	audio_data, err := download(ctx, evt, media)
+	if isExpired(err) {
+		l.Warnf("Audio of message %s is no longer available on the server, skipping: %v", evt.Info.ID, err)
+		react(ctx, evt, *reactError)
+		if settings().expiredMessage != "" {
+			sendReply(ctx, evt, settings().expiredMessage)
+		}
+		return Transcript{}, nil, 0, false
+	} else if isDecryptionError(err) {
+		l.Errorf("Audio of message %s could not be decrypted, the message seems to be corrupt: %v", evt.Info.ID, err)
+		react(ctx, evt, *reactError)
+		if settings().decryptFailedMessage != "" {
+			sendReply(ctx, evt, settings().decryptFailedMessage)
+		}
+		return Transcript{}, nil, 0, false
+	} else if err != nil {
+		l.Errorf("Failed to download audio: %v", err)
+		react(ctx, evt, *reactError)
+		if *deadLetters {
+			saveDeadLetter(evt, err, 1)
+		}
+		return Transcript{}, nil, 0, false
+	}
+	start := time.Now()
+	audio := Audio{Data: audio_data, Mimetype: audioMimetype(media), Language: languageFor(evt), Backend: lookupJID(*chatBackends, evt.Info.Chat)}
+	if audio.Backend != "" {
+		l.Infof("Transcribing message %s with %s as configured for the chat.", evt.Info.ID, audio.Backend)
+	}
+	audio = prepareAudio(ctx, audio)
+	if partial != nil {
+		audio.Partial = partial.Update
+	}
+	transcript, err := transcribe(ctx, audio)
+	if err == nil && settings().retryEmpty && strings.TrimSpace(transcript.Text) == "" && audioSeconds(media) >= uint32(settings().retryEmptySeconds) {
+		// a glitch of the backend, sampling differently usually helps
+		l.Infof("Transcript of message %s with %d seconds of audio is empty, retrying.", evt.Info.ID, audioSeconds(media))
+		audio.Temperature = 0.2
+		transcript, err = transcribe(ctx, audio)
+	}
+	if errors.Is(err, ErrUnsupported) {
+		wav, convErr := convertToWav(ctx, audio)
+		if convErr == nil {
+			l.Infof("Backend cannot read the %s audio of message %s, retrying as wav.", audio.Mimetype, evt.Info.ID)
+			transcript, err = transcribe(ctx, wav)
+		} else {
+			l.Warnf("Backend cannot read the %s audio of message %s and converting it failed: %v", audio.Mimetype, evt.Info.ID, convErr)
+		}
+	}
+	recordAuthResult(err)
+	latency := time.Since(start)
+	if settings().logUsage {
+		l.Infof("Transcription of message %s (%d bytes, %d seconds) with %s took %s.", evt.Info.ID, len(audio_data), audioSeconds(media), transcript.Backend, latency)
+	}
+	if err != nil {
+		l.Warnf("Transcription of message %s failed: %v", evt.Info.ID, err)
+		react(ctx, evt, *reactError)
+		if errors.Is(err, ErrCircuitOpen) && *breakerMessage != "" {
+			sendReply(ctx, evt, *breakerMessage)
+		}
+		if errors.Is(err, ErrUnsupported) && *unsupportedFormatMessage != "" {
+			sendReply(ctx, evt, *unsupportedFormatMessage)
+		}
+		if *dedup && (isTransient(err) || errors.Is(err, ErrCircuitOpen)) {
+			// give it another chance in case the message is delivered again
+			releaseMessage(evt.Info.Chat, evt.Info.ID)
+		}
+		if *deadLetters {
+			saveDeadLetter(evt, err, transcript.Retries+1)
+		}
+		return Transcript{}, nil, 0, false
+	}
+	return transcript, audio_data, latency, true
+}
 
-	resposeBody, err := io.ReadAll(resp.Body)
+// download fetches the media, retrying transient failures with increasing delay.
+func download(ctx context.Context, evt *events.Message, media whatsmeow.DownloadableMessage) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		if downloadSlots != nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case downloadSlots <- struct{}{}:
+			}
+		}
+		data, err := downloader.Download(media)
+		if downloadSlots != nil {
+			<-downloadSlots
+		}
+		retryDecryption := *retryDecryptionFlag && attempt == 0 && isDecryptionError(err)
+		if err == nil || (!retryDecryption && (isPermanentDownloadError(err) || attempt >= settings().downloadRetries)) {
+			return data, err
+		}
+		delay := time.Duration(attempt+1) * time.Second
+		loggerFor(ctx).Warnf("Download attempt %d for message %s failed: %v, retrying in %s...", attempt+1, evt.Info.ID, err, delay)
+		select {
+		case <-ctx.Done():
+			return data, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isExpired reports whether the download failed because the media no longer exists on the server.
+func isExpired(err error) bool {
+	return errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410)
+}
+
+// isPermanentDownloadError reports whether retrying the download cannot help.
+func isPermanentDownloadError(err error) bool {
+	return isExpired(err) ||
+		errors.Is(err, whatsmeow.ErrNoURLPresent) ||
+		errors.Is(err, whatsmeow.ErrUnknownMediaType) ||
+		isDecryptionError(err)
+}
+
+// isDecryptionError reports whether the media was downloaded, but does not match the keys and hashes in the message.
+func isDecryptionError(err error) bool {
+	return errors.Is(err, whatsmeow.ErrInvalidMediaHMAC) ||
+		errors.Is(err, whatsmeow.ErrInvalidMediaEncSHA256) ||
+		errors.Is(err, whatsmeow.ErrInvalidMediaSHA256)
+}
+
+// audioSize returns the size of the audio as announced by the sender, a guess if unknown.
+func audioSize(media whatsmeow.DownloadableMessage) int64 {
+	if sized, ok := media.(interface{ GetFileLength() uint64 }); ok && sized.GetFileLength() > 0 {
+		return int64(sized.GetFileLength())
+	}
+	return 1 << 20
+}
+
+// audioSeconds returns the duration of the audio as announced by the sender, zero if unknown.
+func audioSeconds(media whatsmeow.DownloadableMessage) uint32 {
+	if am, ok := media.(*waProto.AudioMessage); ok {
+		return am.GetSeconds()
+	}
+	return 0
+}
+
+// formatDuration formats the duration like a media player, e.g. 0:47 or 1:02:03.
+func formatDuration(d time.Duration) string {
+	total := int(d.Round(time.Second).Seconds())
+	if total >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", total/3600, total/60%60, total%60)
+	}
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
+
+// audioMimetype returns the mimetype of the audio as announced by the sender.
+func audioMimetype(media whatsmeow.DownloadableMessage) string {
+	if m, ok := media.(interface{ GetMimetype() string }); ok {
+		return m.GetMimetype()
+	}
+	return ""
+}
+
+// isLikelyMusic reports whether the audio is likely music rather than speech.
+// Voice messages are always considered speech. Other audio is considered music
+// if it is long and of a mimetype typically used for music.
+func isLikelyMusic(media whatsmeow.DownloadableMessage) bool {
+	if am, ok := media.(*waProto.AudioMessage); ok && am.GetPTT() {
+		return false
+	}
+	if *musicMinSeconds <= 0 || audioSeconds(media) < uint32(*musicMinSeconds) {
+		return false
+	}
+	base, _, _ := strings.Cut(audioMimetype(media), ";")
+	for _, mimetype := range splitList(*musicMimetypes) {
+		if strings.EqualFold(strings.TrimSpace(base), mimetype) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedCategory checks the category of a message against the allowed categories.
+// Most messages have no category, which is called "normal" here.
+func isAllowedCategory(category string) bool {
+	if category == "" {
+		category = "normal"
+	}
+	for _, allowed := range splitList(settings().allowedCategories) {
+		if strings.EqualFold(allowed, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedMimetype reports whether the mimetype is in the list of allowed mimetypes.
+// Parameters like "; codecs=opus" are ignored. An unknown mimetype is allowed, the format is detected from the data then.
+func isAllowedMimetype(mimetype string) bool {
+	base, _, _ := strings.Cut(mimetype, ";")
+	base = strings.TrimSpace(base)
+	if base == "" {
+		return true
+	}
+	for _, allowed := range splitList(settings().allowedMimetypes) {
+		if strings.EqualFold(base, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// transcribe runs the transcriber, retrying transient failures with increasing delay.
+func transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	name, t, timeout := *backend, transcriber, transcriptionTimeout
+	if audio.Backend != "" && audio.Backend != *backend {
+		name, t = audio.Backend, chatTranscribers[audio.Backend]
+		if *httpTimeout <= 0 {
+			timeout = defaultTimeout(name)
+		}
+	}
+	breaker := breakers[name]
+	for attempt := 0; ; attempt++ {
+		if breaker != nil && !breaker.Allow() {
+			return Transcript{Retries: attempt, Backend: name}, ErrCircuitOpen
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		transcript, err := t.Transcribe(attemptCtx, audio)
+		cancel()
+		if breaker != nil {
+			breaker.Record(err)
+		}
+		transcript.Backend = name
+		transcript.Retries = attempt
+		if err == nil || !isTransient(err) || attempt >= settings().retries {
+			return transcript, err
+		}
+		delay := time.Duration(attempt+1) * 2 * time.Second
+		loggerFor(ctx).Warnf("Transcription failed: %v, retrying in %s...", err, delay)
+		select {
+		case <-ctx.Done():
+			return transcript, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// languageFor returns the language spoken in the message as configured, the sender taking precedence over the chat.
+// It returns an empty string for the backend to detect the language.
+func languageFor(evt *events.Message) string {
+	if language := lookupJID(settings().senderLanguages, evt.Info.Sender.ToNonAD()); language != "" {
+		return language
+	}
+	if language := lookupJID(settings().chatLanguages, evt.Info.Chat); language != "" {
+		return language
+	}
+	return settings().language
+}
+
+// lookupJID finds the JID in a comma separated list like "491701234567@s.whatsapp.net=de" and returns its value.
+// Entries may also be given as phone number only.
+func lookupJID(list string, jid types.JID) string {
+	for _, entry := range splitList(list) {
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimPrefix(strings.TrimSpace(key), "+")
+		if ok && (key == jid.String() || (!strings.Contains(key, "@") && key == jid.User)) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// isWantedLanguage checks the detected language against the configured languages.
+// An unknown language is always wanted.
+func isWantedLanguage(language string) bool {
+	if language == "" {
+		return true
+	}
+	if *onlyLanguages != "" && !matchesLanguage(language, splitList(*onlyLanguages)) {
+		return false
+	}
+	return !matchesLanguage(language, splitList(*skipLanguages))
+}
+
+// matchesLanguage reports whether the language is in the list.
+// A list entry "en" also matches regional variants like "en-US".
+func matchesLanguage(language string, list []string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(language, entry) || strings.HasPrefix(strings.ToLower(language), strings.ToLower(entry)+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated flag value, ignoring surrounding whitespace and empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// sendTranscript delivers the transcript to the chat the voice message was received in.
+// Short transcripts are sent as a reaction or a plain message if configured so,
+// everything else is sent as a reply quoting the voice message.
+// Interactive messages (buttons, lists) are not used, since clients do not show them when sent by a regular account.
+func sendTranscript(ctx context.Context, evt *events.Message, text string) {
+	if *selfChatOnly {
+		self := client().Store.ID.ToNonAD()
+		if evt.Info.Chat != self {
+			// like "reply privately", the quoted message refers to the original chat
+			msg := buildReply(evt, replyText(evt, text))
+			msg.ExtendedTextMessage.ContextInfo.RemoteJID = proto.String(evt.Info.Chat.String())
+			if err := sendMessage(ctx, self, msg); err != nil {
+				transcriptNotSent(ctx, evt, err)
+			}
+			return
+		}
+	}
+	if *asCaption && evt.Info.IsFromMe && evt.Message.GetDocumentMessage() != nil {
+		err := setCaption(ctx, evt, text)
+		if err == nil {
+			return
+		}
+		loggerFor(ctx).Warnf("Failed to set transcript as caption of message %s, replying instead: %v", evt.Info.ID, err)
+	}
+	var msg *waProto.Message
+	trimmed := strings.TrimSpace(text)
+	if isReaction(text) {
+		msg = client().BuildReaction(evt.Info.Chat, evt.Info.Sender, evt.Info.ID, trimmed)
+	} else if isShort(text) {
+		msg = &waProto.Message{Conversation: proto.String(trimmed)}
+	} else {
+		prefix := ""
+		if settings().includeQuotedContext && !*structuredReply {
+			if quoted := renderQuoted(evt.Message); quoted != "" {
+				prefix = fmt.Sprintf("↩️ %s\n", quoted)
+			}
+		}
+		msg = buildThreadedReply(evt, prefix+replyText(evt, text))
+	}
+	if err := sendMessage(ctx, evt.Info.MessageSource.Chat, msg); err != nil {
+		transcriptNotSent(ctx, evt, err)
+	}
+}
+
+// transcriptNotSent reports that the transcript of the message could not be delivered.
+// The voice message is kept as dead letter, if enabled, so the transcript is not lost.
+func transcriptNotSent(ctx context.Context, evt *events.Message, err error) {
+	loggerFor(ctx).Errorf("Failed to send transcript of message %s: %v", evt.Info.ID, err)
+	if *deadLetters {
+		saveDeadLetter(evt, err, 1)
+	}
+}
+
+// truncate shortens the text to at most length characters (plus the suffix), preferably at a word boundary.
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	cut := string(runes[:length])
+	if boundary := strings.LastIndexFunc(cut, unicode.IsSpace); boundary > 0 {
+		cut = cut[:boundary]
+	}
+	return strings.TrimRightFunc(cut, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsPunct(r) }) + settings().truncateSuffix
+}
+
+// stripAnnotations removes non-speech annotations like "[music]" from the transcript.
+func stripAnnotations(text string) string {
+	text = annotations.ReplaceAllString(text, " ")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// isShort reports whether the transcript is to be delivered in short form.
+func isShort(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	threshold := settings().shortThreshold
+	return threshold > 0 && !*structuredReply && trimmed != "" && utf8.RuneCountInString(trimmed) < threshold
+}
+
+// isReaction reports whether the transcript is to be delivered as reaction.
+// Clients only display reactions consisting of a single emoji, other short transcripts are sent as a plain message.
+func isReaction(text string) bool {
+	return settings().shortAsReaction && isShort(text) && isSingleEmoji(strings.TrimSpace(text))
+}
+
+// setCaption edits the document in the message so the transcript becomes its caption.
+// Only the sender of a message can edit it.
+func setCaption(ctx context.Context, evt *events.Message, text string) error {
+	document := proto.Clone(evt.Message.GetDocumentMessage()).(*waProto.DocumentMessage)
+	document.Caption = proto.String(strings.TrimSpace(replyText(evt, text)))
+	edit := client().BuildEdit(evt.Info.Chat, evt.Info.ID, &waProto.Message{DocumentMessage: document})
+	return sendMessage(ctx, evt.Info.Chat, edit)
+}
+
+// renderQuoted returns a short rendering of the message the audio in msg replies to.
+// Media is rendered as a placeholder. It returns an empty string if the audio is not a reply.
+func renderQuoted(msg *waProto.Message) string {
+	quoted := getContextInfo(msg).GetQuotedMessage()
+	if quoted == nil {
+		return ""
+	}
+	var text string
+	switch {
+	case quoted.GetConversation() != "":
+		text = quoted.GetConversation()
+	case quoted.GetExtendedTextMessage() != nil:
+		text = quoted.GetExtendedTextMessage().GetText()
+	case quoted.GetImageMessage() != nil:
+		text = "[image]"
+	case quoted.GetVideoMessage() != nil:
+		text = "[video]"
+	case quoted.GetAudioMessage().GetPTT():
+		text = "[voice message]"
+	case quoted.GetAudioMessage() != nil:
+		text = "[audio]"
+	case quoted.GetDocumentMessage() != nil:
+		text = "[document]"
+	case quoted.GetStickerMessage() != nil:
+		text = "[sticker]"
+	case quoted.GetLocationMessage() != nil || quoted.GetLiveLocationMessage() != nil:
+		text = "[location]"
+	case quoted.GetContactMessage() != nil || quoted.GetContactsArrayMessage() != nil:
+		text = "[contact]"
+	default:
+		text = "[message]"
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > 80 {
+		text = string(runes[:80]) + "…"
+	}
+	return text
+}
+
+// canReply reports whether messages may be sent to the chat of a voice message.
+// Status updates and channels cannot be replied to, and in self-chat-only mode, nothing is sent to the chats.
+func canReply(chat types.JID) bool {
+	return !*selfChatOnly && chat != types.StatusBroadcastJID && chat.Server != types.NewsletterServer
+}
+
+// sendReply sends text to the chat as a reply quoting the received message.
+func sendReply(ctx context.Context, evt *events.Message, text string) {
+	if !canReply(evt.Info.Chat) {
+		return
+	}
+	err := sendMessage(ctx, evt.Info.MessageSource.Chat, buildReply(evt, text))
 	if err != nil {
-		log.Warnf("Transcription: Unable to read response body: %#v", err)
+		loggerFor(ctx).Warnf("Failed to reply to message %s: %v", evt.Info.ID, err)
+	}
+}
+
+// sendMessage sends a message unless replying is disabled. All messages are sent through here.
+func sendMessage(ctx context.Context, chat types.JID, msg *waProto.Message) error {
+	if *noReply {
 		return nil
 	}
-	responseText := string(resposeBody)
-	if resp.StatusCode != http.StatusOK {
-		log.Warnf("Transcription: Got negative response: „%s“", responseText)
+	_, err := sendMessageID(ctx, chat, msg)
+	return err
+}
+
+// sendMessageID is like sendMessage, but also returns the ID of the sent message (empty if replying is disabled).
+func sendMessageID(ctx context.Context, chat types.JID, msg *waProto.Message) (types.MessageID, error) {
+	if *noReply {
+		return "", nil
+	}
+	// the ID is kept for all attempts, so a message which has been delivered without acknowledgement
+	// before is not delivered twice, and it is recognized when it comes back
+	id := messenger.GenerateMessageID()
+	sentMessages.Add(id)
+	for attempt := 0; ; attempt++ {
+		if pacer != nil {
+			pacer.Wait()
+		}
+		_, err := messenger.SendMessage(ctx, chat, msg, whatsmeow.SendRequestExtra{ID: id})
+		if err == nil {
+			return id, nil
+		}
+		if !isTransientSendError(err) || attempt >= *sendRetries {
+			return "", err
+		}
+		delay := time.Duration(1<<attempt) * 2 * time.Second
+		loggerFor(ctx).Warnf("Failed to send message to %s: %v, retrying in %s...", redactJID(chat), err, delay)
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(delay):
+		}
+	}
+}
+
+func buildReply(evt *events.Message, text string) *waProto.Message {
+	return &waProto.Message{
+		ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text: proto.String(text),
+			ContextInfo: &waProto.ContextInfo{
+				StanzaID:      proto.String(evt.Info.ID),
+				Participant:   proto.String(evt.Info.Sender.ToNonAD().String()),
+				QuotedMessage: evt.Message,
+			},
+		},
 	}
-	return &responseText
 }
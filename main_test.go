@@ -0,0 +1,597 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// sentMessage is a message passed to the fakeMessenger.
+type sentMessage struct {
+	chat types.JID
+	msg  *waProto.Message
+}
+
+// fakeMessenger records the messages instead of sending them.
+type fakeMessenger struct {
+	mu   sync.Mutex
+	sent []sentMessage
+	ids  []types.MessageID
+}
+
+func (m *fakeMessenger) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := extra[0].ID
+	m.sent = append(m.sent, sentMessage{to, message})
+	m.ids = append(m.ids, id)
+	return whatsmeow.SendResponse{ID: id, Timestamp: time.Now()}, nil
+}
+
+func (m *fakeMessenger) GenerateMessageID() types.MessageID {
+	return whatsmeow.GenerateMessageID()
+}
+
+func (m *fakeMessenger) messages() []sentMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]sentMessage(nil), m.sent...)
+}
+
+// fakeDownloader returns the same data for all media.
+type fakeDownloader []byte
+
+func (d fakeDownloader) Download(msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	return d, nil
+}
+
+// fakeTranscriber returns the same transcript for all audio.
+type fakeTranscriber string
+
+func (t fakeTranscriber) Transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	return Transcript{Text: string(t)}, nil
+}
+
+// useFakes replaces the client and the backend for the duration of the test.
+func useFakes(t *testing.T, transcript string) *fakeMessenger {
+	t.Helper()
+	fake := &fakeMessenger{}
+	log = waLog.Noop
+	oldMessenger, oldDownloader, oldTranscriber, oldTimeout := messenger, downloader, transcriber, transcriptionTimeout
+	messenger, downloader, transcriber, transcriptionTimeout = fake, fakeDownloader("OggS"), fakeTranscriber(transcript), time.Minute
+	storeSettings()
+	t.Cleanup(func() {
+		messenger, downloader, transcriber, transcriptionTimeout = oldMessenger, oldDownloader, oldTranscriber, oldTimeout
+	})
+	return fake
+}
+
+// setFlag sets the flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	storeSettings()
+	t.Cleanup(func() {
+		flag.Set(name, old)
+		storeSettings()
+	})
+}
+
+// voiceMessage returns a voice message received in a group.
+func voiceMessage() *events.Message {
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    types.NewJID("123456789-987654321", types.GroupServer),
+				Sender:  types.NewADJID("491701234567", 0, 3),
+				IsGroup: true,
+			},
+			ID:        "3EB0AABBCCDDEEFF",
+			Timestamp: time.Now(),
+		},
+		Message: &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			PTT:      proto.Bool(true),
+			Seconds:  proto.Uint32(4),
+			Mimetype: proto.String("audio/ogg; codecs=opus"),
+		}},
+	}
+}
+
+// checkReply checks that the message is a text replying to the voice message.
+func checkReply(t *testing.T, sent sentMessage, evt *events.Message, text string) {
+	t.Helper()
+	if sent.chat != evt.Info.Chat {
+		t.Errorf("reply sent to %s, want %s", sent.chat, evt.Info.Chat)
+	}
+	extended := sent.msg.GetExtendedTextMessage()
+	if extended.GetText() != text {
+		t.Errorf("reply text = %q, want %q", extended.GetText(), text)
+	}
+	contextInfo := extended.GetContextInfo()
+	if contextInfo.GetStanzaID() != evt.Info.ID {
+		t.Errorf("StanzaID = %q, want %q", contextInfo.GetStanzaID(), evt.Info.ID)
+	}
+	if want := evt.Info.Sender.ToNonAD().String(); contextInfo.GetParticipant() != want {
+		t.Errorf("Participant = %q, want %q", contextInfo.GetParticipant(), want)
+	}
+	if !proto.Equal(contextInfo.GetQuotedMessage(), evt.Message) {
+		t.Errorf("QuotedMessage = %v, want %v", contextInfo.GetQuotedMessage(), evt.Message)
+	}
+}
+
+func TestHandleAudioReply(t *testing.T) {
+	fake := useFakes(t, "Hello, this is a test.")
+	setFlag(t, "message-foot", "\n(automatic)")
+	evt := voiceMessage()
+
+	reply := handleAudio(evt, findAudio(evt.Message))
+	if reply == nil {
+		t.Fatal("handleAudio() returned no reply")
+	}
+	if sent := fake.messages(); len(sent) != 0 {
+		t.Fatalf("%d messages sent before replying, want none", len(sent))
+	}
+	reply()
+	sent := fake.messages()
+	if len(sent) != 1 {
+		t.Fatalf("%d messages sent, want 1", len(sent))
+	}
+	checkReply(t, sent[0], evt, "Transcript:\n> Hello, this is a test.\n(automatic)")
+}
+
+// failingStreamTranscriber streams the beginning of a transcript and fails then.
+type failingStreamTranscriber string
+
+func (t failingStreamTranscriber) Transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	audio.Partial(string(t))
+	return Transcript{}, fmt.Errorf("%w: stream aborted", ErrRequest)
+}
+
+// TestStreamFailure makes sure a partial reply does not stay in the chat when the transcription fails.
+func TestStreamFailure(t *testing.T) {
+	fake := useFakes(t, "")
+	transcriber = failingStreamTranscriber("Hello, this")
+	setFlag(t, "stream", "true")
+	useHandler(t)
+	evt := voiceMessage()
+
+	if reply := handleAudio(evt, findAudio(evt.Message)); reply != nil {
+		t.Fatal("handleAudio() returned a reply for a failed transcription")
+	}
+	sent := fake.messages()
+	if len(sent) != 2 {
+		t.Fatalf("%d messages sent, want the partial reply and its deletion", len(sent))
+	}
+	if text := sent[0].msg.GetExtendedTextMessage().GetText(); text != "Transcript:\n> Hello, this …" {
+		t.Errorf("partial reply = %q, want the transcript so far", text)
+	}
+	revoke := sent[1].msg.GetProtocolMessage()
+	if revoke.GetType() != waProto.ProtocolMessage_REVOKE || revoke.GetKey().GetID() != fake.ids[0] {
+		t.Errorf("second message = %v, want the deletion of the partial reply %s", sent[1].msg, fake.ids[0])
+	}
+}
+
+func TestSendTranscript(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]string
+		text  string
+		check func(t *testing.T, sent sentMessage, evt *events.Message)
+	}{
+		{"reply", nil, "A longer transcript.", func(t *testing.T, sent sentMessage, evt *events.Message) {
+			checkReply(t, sent, evt, "Transcript:\n> A longer transcript.")
+		}},
+		{"short", map[string]string{"short-threshold": "10"}, " ok ", func(t *testing.T, sent sentMessage, evt *events.Message) {
+			if sent.msg.GetConversation() != "ok" || sent.msg.GetExtendedTextMessage() != nil {
+				t.Errorf("short reply = %v, want plain text \"ok\"", sent.msg)
+			}
+		}},
+		{"short as reaction", map[string]string{"short-threshold": "10", "short-as-reaction": "true"}, "👍", func(t *testing.T, sent sentMessage, evt *events.Message) {
+			reaction := sent.msg.GetReactionMessage()
+			if reaction.GetText() != "👍" || reaction.GetKey().GetID() != evt.Info.ID {
+				t.Errorf("short reply = %v, want reaction 👍 to %s", sent.msg, evt.Info.ID)
+			}
+		}},
+		{"short as reaction, not an emoji", map[string]string{"short-threshold": "10", "short-as-reaction": "true"}, "ok", func(t *testing.T, sent sentMessage, evt *events.Message) {
+			if sent.msg.GetConversation() != "ok" {
+				t.Errorf("short reply = %v, want plain text \"ok\"", sent.msg)
+			}
+		}},
+		{"not threaded", map[string]string{"thread": "none"}, "Not quoting.", func(t *testing.T, sent sentMessage, evt *events.Message) {
+			extended := sent.msg.GetExtendedTextMessage()
+			if extended.GetText() != "Transcript:\n> Not quoting." || extended.GetContextInfo() != nil {
+				t.Errorf("reply = %v, want text without context", sent.msg)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := useFakes(t, "")
+			useHandler(t)
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			evt := voiceMessage()
+			sendTranscript(context.Background(), evt, test.text)
+			sent := fake.messages()
+			if len(sent) != 1 {
+				t.Fatalf("%d messages sent, want 1", len(sent))
+			}
+			test.check(t, sent[0], evt)
+		})
+	}
+}
+
+func TestStripAnnotations(t *testing.T) {
+	annotations = regexp.MustCompile(flagDefault(t, "annotation-pattern"))
+	defer func() { annotations = nil }()
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Hello [music] world", "Hello world"},
+		{"(laughter) That is funny.", "That is funny."},
+		{"I was (inaudible) there", "I was there"},
+		{"*coughs* Sorry.", "Sorry."},
+		{"♪ ♪", ""},
+		{"♪♫ la la la ♫", "la la la"},
+		{"[BLANK_AUDIO]", ""},
+		{"No annotations here.", "No annotations here."},
+		{"  spaces   are   collapsed ", "spaces are collapsed"},
+	}
+	for _, test := range tests {
+		got := stripAnnotations(test.text)
+		if got != test.want {
+			t.Errorf("stripAnnotations(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+// flagDefault returns the default value of the flag.
+func flagDefault(t *testing.T, name string) string {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("unknown flag %s", name)
+	}
+	return f.DefValue
+}
+
+func TestFindAudio(t *testing.T) {
+	voice := &waProto.AudioMessage{PTT: proto.Bool(true), Mimetype: proto.String("audio/ogg; codecs=opus")}
+	music := &waProto.AudioMessage{Mimetype: proto.String("audio/mpeg")}
+	document := &waProto.DocumentMessage{Mimetype: proto.String("audio/mpeg"), Caption: proto.String("Recording")}
+	tests := []struct {
+		name  string
+		msg   *waProto.Message
+		flags map[string]string
+		want  []whatsmeow.DownloadableMessage
+	}{
+		{"voice message", &waProto.Message{AudioMessage: voice}, nil, []whatsmeow.DownloadableMessage{voice}},
+		{"view once", &waProto.Message{ViewOnceMessageV2Extension: &waProto.FutureProofMessage{
+			Message: &waProto.Message{AudioMessage: voice},
+		}}, nil, []whatsmeow.DownloadableMessage{voice}},
+		{"nested wrappers", &waProto.Message{EphemeralMessage: &waProto.FutureProofMessage{
+			Message: &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+				Message: &waProto.Message{AudioMessage: voice},
+			}},
+		}}, nil, []whatsmeow.DownloadableMessage{voice}},
+		{"group mention", &waProto.Message{GroupMentionedMessage: &waProto.FutureProofMessage{
+			Message: &waProto.Message{AudioMessage: voice},
+		}}, nil, []whatsmeow.DownloadableMessage{voice}},
+		// an album only announces its items, each one is a message of its own associated with the album
+		{"album", &waProto.Message{AlbumMessage: &waE2E.AlbumMessage{Caption: proto.String("Holidays")}}, nil, nil},
+		{"album item", &waProto.Message{
+			AudioMessage: voice,
+			MessageContextInfo: &waProto.MessageContextInfo{MessageAssociation: &waE2E.MessageAssociation{
+				AssociationType: waE2E.MessageAssociation_MEDIA_ALBUM.Enum(),
+			}},
+		}, nil, []whatsmeow.DownloadableMessage{voice}},
+		{"other audio", &waProto.Message{AudioMessage: music}, nil, nil},
+		{"other audio, all audio", &waProto.Message{AudioMessage: music}, map[string]string{"transcribe-all-audio": "true"}, []whatsmeow.DownloadableMessage{music}},
+		{"audio document", &waProto.Message{DocumentWithCaptionMessage: &waProto.FutureProofMessage{
+			Message: &waProto.Message{DocumentMessage: document},
+		}}, map[string]string{"transcribe-audio-documents": "true"}, []whatsmeow.DownloadableMessage{document}},
+		{"audio document, not enabled", &waProto.Message{DocumentMessage: document}, nil, nil},
+		{"audio and audio document", &waProto.Message{AudioMessage: voice, DocumentMessage: document},
+			map[string]string{"transcribe-audio-documents": "true"}, []whatsmeow.DownloadableMessage{voice, document}},
+		{"text", &waProto.Message{Conversation: proto.String("Hello")}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.flags {
+				setFlag(t, name, value)
+			}
+			got := findAudio(test.msg)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("findAudio() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestOwnRepliesAreIgnored makes sure a transcript is never taken as input, even though
+// it quotes the voice message and transcribe-quoted would transcribe the voice message it replies to.
+func TestOwnRepliesAreIgnored(t *testing.T) {
+	fake := useFakes(t, "Hello, this is a test.")
+	setFlag(t, "dedup", "false")
+	setFlag(t, "transcribe-quoted", "true")
+	own := useHandler(t)
+
+	evt := voiceMessage()
+	handler(evt)
+	waitForQueue(t, evt.Info.Chat)
+	sent := fake.messages()
+	if len(sent) != 1 {
+		t.Fatalf("%d messages sent for the voice message, want 1", len(sent))
+	}
+
+	// the transcript comes back as a message of this account
+	echo := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: sent[0].chat, Sender: own, IsFromMe: true, IsGroup: true},
+			ID:            fake.ids[0],
+			Timestamp:     time.Now(),
+		},
+		Message: sent[0].msg,
+	}
+	handler(echo)
+	waitForQueue(t, echo.Info.Chat)
+	if sent := fake.messages(); len(sent) != 1 {
+		t.Fatalf("%d messages sent after the own transcript came back, want still 1", len(sent))
+	}
+
+	// someone else replying with the same content has the voice message transcribed
+	other := *echo
+	other.Info.ID = "3EB0FFEEDDCCBBAA"
+	other.Info.Sender = types.NewJID("491701111111", types.DefaultUserServer)
+	other.Info.IsFromMe = false
+	handler(&other)
+	waitForQueue(t, other.Info.Chat)
+	if sent := fake.messages(); len(sent) != 2 {
+		t.Fatalf("%d messages sent after another reply to the voice message, want 2", len(sent))
+	}
+}
+
+// fakeContacts knows the push names of some users.
+type fakeContacts map[types.JID]string
+
+func (c fakeContacts) GetContact(user types.JID) (types.ContactInfo, error) {
+	name, ok := c[user]
+	return types.ContactInfo{Found: ok, PushName: name}, nil
+}
+
+func (c fakeContacts) PutPushName(user types.JID, pushName string) (bool, string, error) {
+	return false, "", nil
+}
+
+func (c fakeContacts) PutBusinessName(user types.JID, businessName string) (bool, string, error) {
+	return false, "", nil
+}
+
+func (c fakeContacts) PutContactName(user types.JID, fullName, firstName string) error {
+	return nil
+}
+
+func (c fakeContacts) PutAllContactNames(contacts []store.ContactEntry) error {
+	return nil
+}
+
+func (c fakeContacts) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+	return nil, nil
+}
+
+// useHandler sets up what the event handler needs besides the fakes, as if connected for a while.
+// It returns the JID of this account.
+func useHandler(t *testing.T) types.JID {
+	t.Helper()
+	own := types.NewADJID("491709876543", 0, 12)
+	oldClient, oldQueue, oldConnectedAt := client(), queue, connectedAt
+	activeClient.Store(whatsmeow.NewClient(&store.Device{ID: &own, PushName: "Transcriber", Contacts: fakeContacts{
+		types.NewJID("491701234567", types.DefaultUserServer): "Alice",
+	}}, nil))
+	queue = newChatQueue(context.Background(), 1, 0, 0)
+	connectedAt = time.Now().Add(-time.Hour)
+	t.Cleanup(func() {
+		activeClient.Store(oldClient)
+		queue, connectedAt = oldQueue, oldConnectedAt
+	})
+	return own
+}
+
+// waitForQueue waits until the jobs enqueued for the chat so far (and their follow-ups) are done.
+func waitForQueue(t *testing.T, chat types.JID) {
+	t.Helper()
+	done := make(chan struct{})
+	if err := queue.Enqueue(chat, func() func() { close(done); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue did not finish in time")
+	}
+}
+
+// perMimetypeTranscriber returns the transcript for the mimetype of the audio.
+type perMimetypeTranscriber map[string]string
+
+func (t perMimetypeTranscriber) Transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	return Transcript{Text: t[audio.Mimetype]}, nil
+}
+
+// TestMultipleAudio checks a message with a voice recording and an audio document, which official clients do not send.
+// Both are transcribed, in a single reply with a section for each one.
+func TestMultipleAudio(t *testing.T) {
+	fake := useFakes(t, "")
+	transcriber = perMimetypeTranscriber{
+		"audio/ogg; codecs=opus": "The voice recording.",
+		"audio/mpeg":             "The audio document.",
+	}
+	setFlag(t, "dedup", "false")
+	setFlag(t, "transcribe-audio-documents", "true")
+	useHandler(t)
+
+	evt := voiceMessage()
+	document := &waProto.DocumentMessage{Mimetype: proto.String("audio/mpeg"), FileName: proto.String("recording.mp3")}
+	evt.Message.DocumentMessage = document
+	handler(evt)
+	waitForQueue(t, evt.Info.Chat)
+	sent := fake.messages()
+	if len(sent) != 1 {
+		t.Fatalf("%d messages sent, want 1", len(sent))
+	}
+	checkReply(t, sent[0], evt, "Transcript:\n> Audio 1 of 2:\nThe voice recording.\n\nAudio 2 of 2 (recording.mp3):\nThe audio document.")
+}
+
+func TestCitation(t *testing.T) {
+	tests := []struct {
+		chat types.JID
+		want string
+	}{
+		{types.NewJID("491701234567", types.DefaultUserServer), "📝 private chat, "},
+		{types.StatusBroadcastJID, "📝 status update, "},
+		{types.NewJID("120363012345678901", types.NewsletterServer), "📝 channel 120363012345678901@newsletter, "},
+	}
+	for _, test := range tests {
+		evt := voiceMessage()
+		evt.Info.Chat = test.chat
+		evt.Info.IsGroup = false
+		got := citation(context.Background(), evt)
+		if !strings.HasPrefix(got, test.want) {
+			t.Errorf("citation() in %s = %q, want prefix %q", test.chat, got, test.want)
+		}
+	}
+}
+
+// TestQueueFullReleasesClaim makes sure a voice message rejected for a full queue can be transcribed when it comes again.
+func TestQueueFullReleasesClaim(t *testing.T) {
+	useFakes(t, "Hello, this is a test.")
+	setFlag(t, "dedup", "true")
+	useHandler(t)
+	openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	queue = newChatQueue(context.Background(), 1, 0, 1)
+	evt := voiceMessage()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	if err := queue.Enqueue(evt.Info.Chat, func() func() { close(started); <-release; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := queue.Enqueue(evt.Info.Chat, func() func() { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	enqueueAudio(evt, findAudio(evt.Message))
+	if rejectedCount.Load() == 0 {
+		t.Fatal("voice message has not been rejected")
+	}
+	claimed, err := claimMessage(evt.Info.Chat, evt.Info.ID)
+	if err != nil || !claimed {
+		t.Errorf("claim after rejection: claimed=%v err=%v, want claimed", claimed, err)
+	}
+}
+
+// disconnectedMessenger fails to send any message, as if the connection were lost.
+type disconnectedMessenger struct {
+	fakeMessenger
+}
+
+func (m *disconnectedMessenger) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	return whatsmeow.SendResponse{}, whatsmeow.ErrNotConnected
+}
+
+// TestUndeliveredTranscript makes sure sending gives up on shutdown and the transcript is kept as dead letter.
+func TestUndeliveredTranscript(t *testing.T) {
+	useFakes(t, "")
+	messenger = &disconnectedMessenger{}
+	setFlag(t, "dead-letters", "true")
+	useHandler(t)
+	openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	defer db.Close()
+	evt := voiceMessage()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	sendTranscript(ctx, evt, "Never delivered.")
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("sending took %s after the context was done, want it to give up", took)
+	}
+	var reason string
+	err := db.QueryRow("SELECT reason FROM transcribe_dead_letters WHERE chat = $1 AND message_id = $2", evt.Info.Chat.String(), evt.Info.ID).Scan(&reason)
+	if err != nil {
+		t.Fatalf("no dead letter for the undelivered transcript: %v", err)
+	}
+	if reason != whatsmeow.ErrNotConnected.Error() {
+		t.Errorf("reason = %q, want %q", reason, whatsmeow.ErrNotConnected)
+	}
+}
+
+// TestQuotedAudio checks the event for a voice message someone replies to, which does not take over details of the reply.
+func TestQuotedAudio(t *testing.T) {
+	useFakes(t, "")
+	useHandler(t)
+	voice := voiceMessage()
+	reply := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    voice.Info.Chat,
+				Sender:  types.NewJID("491701111111", types.DefaultUserServer),
+				IsGroup: true,
+			},
+			ID:        "3EB0FFEEDDCCBBAA",
+			PushName:  "Bob",
+			Timestamp: time.Now(),
+		},
+		Message: &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text: proto.String("What did you say?"),
+			ContextInfo: &waProto.ContextInfo{
+				StanzaID:      proto.String(voice.Info.ID),
+				Participant:   proto.String("491701234567@s.whatsapp.net"),
+				QuotedMessage: voice.Message,
+			},
+		}},
+	}
+	quoted := quotedAudio(reply)
+	if quoted == nil {
+		t.Fatal("quotedAudio() = nil, want the voice message")
+	}
+	if quoted.Info.ID != voice.Info.ID || quoted.Info.Sender.User != voice.Info.Sender.User {
+		t.Errorf("quoted message %s from %s, want %s from %s", quoted.Info.ID, quoted.Info.Sender, voice.Info.ID, voice.Info.Sender)
+	}
+	if quoted.Info.PushName != "Alice" {
+		t.Errorf("PushName = %q, want the name of the sender of the voice message", quoted.Info.PushName)
+	}
+	if !quoted.Info.Timestamp.IsZero() {
+		t.Errorf("Timestamp = %s, want unknown", quoted.Info.Timestamp)
+	}
+	if got := citation(context.Background(), quoted); strings.Contains(got, "0001") {
+		t.Errorf("citation() = %q, want no time", got)
+	}
+}
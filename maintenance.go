@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// maintainDB prunes expired rows and compacts the database at the interval, until the program shuts down.
+func maintainDB(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-runCtx.Done():
+			return
+		case <-ticker.C:
+			runMaintenance()
+		}
+	}
+}
+
+func runMaintenance() {
+	now := time.Now()
+	if *handledRetention > 0 {
+		result, err := db.Exec("DELETE FROM transcribe_handled WHERE handled_at < $1", now.Add(-*handledRetention).Unix())
+		logPruned("handled messages", result, err)
+	}
+	if *transcriptRetention > 0 {
+		result, err := db.Exec("DELETE FROM transcribe_transcripts WHERE timestamp < $1", now.Add(-*transcriptRetention).Unix())
+		logPruned("transcripts", result, err)
+	}
+	before := databaseSize()
+	var err error
+	if *dbDialect == "sqlite3" {
+		_, err = db.Exec("VACUUM")
+	} else {
+		// only the tables of this program, the store of the WhatsApp library takes care of itself
+		_, err = db.Exec("VACUUM transcribe_handled, transcribe_transcripts, transcribe_jobs, transcribe_dead_letters")
+	}
+	if err != nil {
+		log.Warnf("Failed to compact the database: %v", err)
+		return
+	}
+	after := databaseSize()
+	if before > 0 && after > 0 {
+		log.Infof("Database maintenance took %s, reclaimed %d kB.", time.Since(now).Round(time.Millisecond), (before-after)/1024)
+	}
+}
+
+func logPruned(what string, result sql.Result, err error) {
+	if err != nil {
+		log.Warnf("Failed to prune %s: %v", what, err)
+		return
+	}
+	if pruned, err := result.RowsAffected(); err == nil && pruned > 0 {
+		log.Infof("Pruned %d expired %s from the database.", pruned, what)
+	}
+}
+
+// databaseSize returns the size of the database in bytes, zero if unknown.
+func databaseSize() int64 {
+	var size int64
+	var err error
+	if *dbDialect == "sqlite3" {
+		err = db.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	} else {
+		err = db.QueryRow("SELECT pg_database_size(current_database())").Scan(&size)
+	}
+	if err != nil {
+		log.Debugf("Failed to determine the size of the database: %v", err)
+		return 0
+	}
+	return size
+}
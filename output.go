@@ -0,0 +1,149 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// transcriptSchemaVersion is increased on incompatible changes of TranscriptEvent.
+// Adding fields is not considered incompatible.
+const transcriptSchemaVersion = 1
+
+// TranscriptEvent is written to the transcript log and posted to the webhook.
+// Both outputs use exactly the same JSON, so consumers need to handle one shape only.
+type TranscriptEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          string    `json:"type"`
+	Chat          string    `json:"chat"`
+	Sender        string    `json:"sender"`
+	MessageID     string    `json:"message_id"`
+	Timestamp     time.Time `json:"timestamp,omitzero"`
+	Duration      uint32    `json:"duration_seconds"`
+	Language      string    `json:"language"`
+	Backend       string    `json:"backend"`
+	Text          string    `json:"text"`
+	Confidence    float64   `json:"confidence,omitempty"`
+	Retries       int       `json:"retries"`
+	LatencyMs     int64     `json:"latency_ms"`
+	RequestID     string    `json:"request_id"`
+}
+
+func newTranscriptEvent(ctx context.Context, evt *events.Message, seconds uint32, transcript Transcript, latency time.Duration) TranscriptEvent {
+	return TranscriptEvent{
+		SchemaVersion: transcriptSchemaVersion,
+		Type:          "transcript",
+		Chat:          evt.Info.Chat.String(),
+		Sender:        evt.Info.Sender.ToNonAD().String(),
+		MessageID:     evt.Info.ID,
+		Timestamp:     evt.Info.Timestamp,
+		Duration:      seconds,
+		Language:      transcript.Language,
+		Backend:       transcript.Backend,
+		Text:          transcript.Text,
+		Confidence:    transcript.Confidence,
+		Retries:       transcript.Retries,
+		LatencyMs:     latency.Milliseconds(),
+		RequestID:     requestID(ctx),
+	}
+}
+
+// AlertEvent is posted to the webhook in case of unusual transcription volume.
+type AlertEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          string    `json:"type"`
+	Timestamp     time.Time `json:"timestamp"`
+	Metric        string    `json:"metric"`
+	Value         float64   `json:"value"`
+	Average       float64   `json:"average"`
+}
+
+var transcriptLogMutex sync.Mutex
+
+// structuredReplyText renders the event as a reply for bots. The JSON is the same as in the transcript log,
+// wrapped in a code block so WhatsApp does not apply formatting to it.
+func structuredReplyText(event TranscriptEvent) string {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		// cannot happen with the types involved
+		return event.Text
+	}
+	return "```\n" + string(payload) + "\n```"
+}
+
+// emit writes the event to the transcript log and posts it to the webhook, as far as they are configured.
+// The webhook is called in the background.
+func emit(event TranscriptEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Warnf("Failed to encode %s event: %v", event.Type, err)
+		return
+	}
+	if *transcriptLog != "" {
+		err = appendTranscriptLog(payload)
+		if err != nil {
+			log.Warnf("Failed to write to transcript log: %v", err)
+		}
+	}
+	emitWebhook(event.Type, payload)
+}
+
+// emitAlert posts the alert to the webhook, if configured. Alerts are not written to the transcript log.
+func emitAlert(event AlertEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Warnf("Failed to encode %s event: %v", event.Type, err)
+		return
+	}
+	emitWebhook(event.Type, payload)
+}
+
+func emitWebhook(eventType string, payload []byte) {
+	if *webhookURL != "" {
+		go func() {
+			err := postWebhook(payload)
+			if err != nil {
+				log.Warnf("Failed to post %s event to webhook: %v", eventType, err)
+			}
+		}()
+	}
+}
+
+// appendTranscriptLog appends the payload as one line to the transcript log.
+func appendTranscriptLog(payload []byte) error {
+	transcriptLogMutex.Lock()
+	defer transcriptLogMutex.Unlock()
+	file, err := os.OpenFile(*transcriptLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(payload, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func postWebhook(payload []byte) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(*webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got negative response: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync/atomic"
+)
+
+// paused is set while voice messages are to be ignored, e.g. during an incident. The session stays connected.
+var paused atomic.Bool
+
+// setPaused pauses or resumes the transcription of voice messages. The cause is logged.
+func setPaused(pause bool, cause string) {
+	if paused.Swap(pause) == pause {
+		log.Infof("Transcription is %s already (%s).", pausedState(pause), cause)
+		return
+	}
+	log.Warnf("Transcription is %s now (%s).", pausedState(pause), cause)
+}
+
+func pausedState(pause bool) string {
+	if pause {
+		return "paused"
+	}
+	return "running"
+}
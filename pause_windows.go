@@ -0,0 +1,10 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build windows
+
+package main
+
+// handlePauseSignals does nothing, Windows has no user signals. Use the HTTP endpoint instead.
+func handlePauseSignals() {}
@@ -0,0 +1,151 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+var (
+	ErrQueueFull    = errors.New("queue is full")
+	ErrQueueDrained = errors.New("queue has been drained")
+)
+
+// chatQueue runs jobs of the same chat one after another in the order they were enqueued.
+// Jobs of different chats run in parallel, limited by the number of slots.
+// A job may return a follow-up which runs after the slot has been released,
+// but still before the next job of the same chat.
+// Each job waits for a random time up to jitter before it starts, so bursts of jobs are spread out.
+// Once ctx is done or the queue is drained, no more jobs are started.
+// With a size, at most this many jobs wait to be started, further ones are rejected.
+type chatQueue struct {
+	ctx     context.Context
+	jitter  time.Duration
+	size    int
+	mu      sync.Mutex
+	pending map[types.JID][]func() func()
+	slots   chan struct{}
+	// waiting counts the jobs enqueued, until they are started or dropped
+	waiting atomic.Int64
+	// running counts the jobs taken from pending, until their follow-up is done
+	running  sync.WaitGroup
+	draining chan struct{}
+	drained  bool
+}
+
+func newChatQueue(ctx context.Context, concurrency int, jitter time.Duration, size int) *chatQueue {
+	return &chatQueue{
+		ctx:      ctx,
+		jitter:   jitter,
+		size:     size,
+		pending:  make(map[types.JID][]func() func()),
+		slots:    make(chan struct{}, max(concurrency, 1)),
+		draining: make(chan struct{}),
+	}
+}
+
+// Enqueue adds the job for the chat unless the queue is full or has been drained.
+func (q *chatQueue) Enqueue(chat types.JID, job func() func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.drained {
+		return ErrQueueDrained
+	}
+	if q.size > 0 && q.waiting.Load() >= int64(q.size) {
+		return ErrQueueFull
+	}
+	q.waiting.Add(1)
+	jobs, running := q.pending[chat]
+	q.pending[chat] = append(jobs, job)
+	if !running {
+		go q.run(chat)
+	}
+	return nil
+}
+
+// Depth returns the number of jobs waiting to be started.
+func (q *chatQueue) Depth() int {
+	return int(q.waiting.Load())
+}
+
+// run works through the jobs of one chat. It stops once there is nothing left to do.
+func (q *chatQueue) run(chat types.JID) {
+	for {
+		q.mu.Lock()
+		jobs := q.pending[chat]
+		if len(jobs) == 0 || q.drained {
+			q.waiting.Add(-int64(len(jobs)))
+			delete(q.pending, chat)
+			q.mu.Unlock()
+			return
+		}
+		job := jobs[0]
+		q.pending[chat] = jobs[1:]
+		q.running.Add(1)
+		q.mu.Unlock()
+
+		if !q.runJob(job) {
+			return
+		}
+	}
+}
+
+// runJob waits for a slot and runs the job with its follow-up.
+// It reports false in case the job has not been started since the queue is shutting down.
+func (q *chatQueue) runJob(job func() func()) bool {
+	defer q.running.Done()
+	if q.jitter > 0 {
+		select {
+		case <-q.ctx.Done():
+		case <-q.draining:
+		case <-time.After(time.Duration(rand.Int63n(int64(q.jitter)))):
+		}
+	}
+	select {
+	case <-q.ctx.Done():
+		q.waiting.Add(-1)
+		return false
+	case <-q.draining:
+		q.waiting.Add(-1)
+		return false
+	case q.slots <- struct{}{}:
+		q.waiting.Add(-1)
+	}
+	followUp := job()
+	<-q.slots
+	if followUp != nil {
+		followUp()
+	}
+	return true
+}
+
+// Drain stops starting jobs and waits for the running ones to finish, at most for the timeout.
+// Jobs not started yet are dropped. It reports whether all running jobs have finished.
+func (q *chatQueue) Drain(timeout time.Duration) bool {
+	q.mu.Lock()
+	if !q.drained {
+		q.drained = true
+		close(q.draining)
+	}
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
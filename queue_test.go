@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestChatQueueDrain(t *testing.T) {
+	q := newChatQueue(context.Background(), 2, 0, 0)
+	chat := types.NewJID("491701234567", types.DefaultUserServer)
+	other := types.NewJID("491709876543", types.DefaultUserServer)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var followedUp, startedLater atomic.Bool
+	slow := func() func() {
+		close(started)
+		<-release
+		return func() { followedUp.Store(true) }
+	}
+	if err := q.Enqueue(chat, slow); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// waits behind the slow job of the same chat
+	if err := q.Enqueue(chat, func() func() { startedLater.Store(true); return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Drain(50 * time.Millisecond) {
+		t.Error("Drain() = true while a job is still running, want false")
+	}
+	if err := q.Enqueue(other, func() func() { startedLater.Store(true); return nil }); !errors.Is(err, ErrQueueDrained) {
+		t.Errorf("Enqueue() after Drain() = %v, want %v", err, ErrQueueDrained)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	if !q.Drain(5 * time.Second) {
+		t.Fatal("Drain() = false after the job finished, want true")
+	}
+	if !followedUp.Load() {
+		t.Error("follow-up of the running job did not run")
+	}
+	if startedLater.Load() {
+		t.Error("a job not started before draining has been started")
+	}
+}
+
+func TestChatQueueSize(t *testing.T) {
+	q := newChatQueue(context.Background(), 1, 0, 1)
+	chat := types.NewJID("491701234567", types.DefaultUserServer)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	if err := q.Enqueue(chat, func() func() { close(started); <-release; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := q.Enqueue(chat, func() func() { return nil }); err != nil {
+		t.Fatalf("Enqueue() with room in the queue = %v, want nil", err)
+	}
+	if depth := q.Depth(); depth != 1 {
+		t.Errorf("Depth() = %d, want 1", depth)
+	}
+	if err := q.Enqueue(chat, func() func() { return nil }); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue() with a full queue = %v, want %v", err, ErrQueueFull)
+	}
+}
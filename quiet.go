@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// quietHours is a daily time window in which no replies are sent.
+// Replies due within the window are held back and sent in order once the window is over.
+// The window may span midnight (e.g. 22:00 to 07:00).
+type quietHours struct {
+	start    int // minutes after midnight
+	end      int // minutes after midnight
+	location *time.Location
+	mu       sync.Mutex
+	held     []func()
+	timer    *time.Timer
+}
+
+func newQuietHours(start string, end string, timezone string) (*quietHours, error) {
+	startTime, err := time.Parse("15:04", start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start of quiet hours %q: %w", start, err)
+	}
+	endTime, err := time.Parse("15:04", end)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end of quiet hours %q: %w", end, err)
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone for quiet hours %q: %w", timezone, err)
+	}
+	return &quietHours{
+		start:    startTime.Hour()*60 + startTime.Minute(),
+		end:      endTime.Hour()*60 + endTime.Minute(),
+		location: location,
+	}, nil
+}
+
+// Active reports whether t is within the quiet hours.
+func (q *quietHours) Active(t time.Time) bool {
+	t = t.In(q.location)
+	minute := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return q.start <= minute && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// nextEnd returns the next end of the quiet hours after t.
+func (q *quietHours) nextEnd(t time.Time) time.Time {
+	t = t.In(q.location)
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, q.location)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+// Hold keeps send back until the quiet hours are over.
+func (q *quietHours) Hold(send func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held = append(q.held, send)
+	if q.timer == nil {
+		end := q.nextEnd(time.Now())
+		log.Infof("Quiet hours, holding back replies until %s.", end)
+		q.timer = time.AfterFunc(time.Until(end), q.release)
+	}
+}
+
+// release sends all replies held back, in the order they were held back.
+func (q *quietHours) release() {
+	q.mu.Lock()
+	held := q.held
+	q.held = nil
+	q.timer = nil
+	q.mu.Unlock()
+	log.Infof("Quiet hours are over, sending %d replies held back.", len(held))
+	for _, send := range held {
+		send()
+	}
+}
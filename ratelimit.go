@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// chatRateLimiter limits the number of replies per chat within a sliding window.
+// Once a chat is over the limit, further messages are skipped. After the window has passed,
+// summarize is called once with the number of skipped messages.
+type chatRateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	chats     map[types.JID]*chatRate
+	summarize func(chat types.JID, skipped int)
+}
+
+type chatRate struct {
+	replies []time.Time
+	skipped int
+}
+
+func newChatRateLimiter(limit int, window time.Duration, summarize func(chat types.JID, skipped int)) *chatRateLimiter {
+	return &chatRateLimiter{
+		limit:     limit,
+		window:    window,
+		chats:     make(map[types.JID]*chatRate),
+		summarize: summarize,
+	}
+}
+
+// Allow reports whether a reply may be sent to the chat and counts it if so.
+func (l *chatRateLimiter) Allow(chat types.JID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	rate := l.chats[chat]
+	if rate == nil {
+		rate = &chatRate{}
+		l.chats[chat] = rate
+	}
+	if len(rate.replies) < l.limit {
+		rate.replies = append(rate.replies, now)
+		return true
+	}
+	if rate.skipped == 0 {
+		time.AfterFunc(rate.replies[0].Add(l.window).Sub(now), func() { l.flush(chat) })
+	}
+	rate.skipped++
+	return false
+}
+
+// flush reports the skipped messages of the chat.
+func (l *chatRateLimiter) flush(chat types.JID) {
+	l.mu.Lock()
+	skipped := 0
+	if rate := l.chats[chat]; rate != nil {
+		skipped = rate.skipped
+		rate.skipped = 0
+	}
+	l.mu.Unlock()
+	if skipped > 0 {
+		l.summarize(chat, skipped)
+	}
+}
+
+// prune forgets replies which are out of the window and chats which are idle.
+func (l *chatRateLimiter) prune(now time.Time) {
+	for chat, rate := range l.chats {
+		for len(rate.replies) > 0 && now.Sub(rate.replies[0]) >= l.window {
+			rate.replies = rate.replies[1:]
+		}
+		if len(rate.replies) == 0 && rate.skipped == 0 {
+			delete(l.chats, chat)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// react sets the reaction of this account on the received message. An empty reaction removes it.
+// This is used to indicate the progress of the transcription.
+func react(ctx context.Context, evt *events.Message, reaction string) {
+	if !*reactProgress || !canReply(evt.Info.Chat) {
+		return
+	}
+	err := sendMessage(ctx, evt.Info.Chat, client().BuildReaction(evt.Info.Chat, evt.Info.Sender, evt.Info.ID, reaction))
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to react to message %s: %v", evt.Info.ID, err)
+	}
+}
+
+// isSingleEmoji reports whether s is exactly one emoji, including emoji made up of several code points
+// (skin tones, flags, keycaps, ZWJ sequences). WhatsApp only displays reactions which are a single emoji.
+func isSingleEmoji(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return false
+	}
+	if len(runes) == 2 && isRegionalIndicator(runes[0]) && isRegionalIndicator(runes[1]) {
+		return true
+	}
+	if !isEmojiBase(runes) {
+		return false
+	}
+	for i := 1; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\u200d':
+			// zero width joiner, must be followed by another emoji
+			if i+1 >= len(runes) || !isEmojiBase(runes[i+1:]) {
+				return false
+			}
+			i++
+		case isExtending(r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isEmojiBase reports whether the runes start with the base of an emoji, which is a symbol
+// or the digit, # or * of a keycap. A regional indicator is an emoji only as part of a flag.
+func isEmojiBase(runes []rune) bool {
+	if strings.ContainsRune("0123456789#*", runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == '\ufe0f' {
+			rest = rest[1:]
+		}
+		return len(rest) > 0 && rest[0] == '\u20e3'
+	}
+	return unicode.Is(unicode.So, runes[0]) && !isRegionalIndicator(runes[0])
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// isExtending reports whether r modifies the preceding character rather than starting a new one.
+func isExtending(r rune) bool {
+	return r == '\ufe0e' || r == '\ufe0f' || // variation selectors
+		(r >= 0x1F3FB && r <= 0x1F3FF) || // skin tones
+		r == '\u20e3' || // keycap
+		(r >= 0xE0020 && r <= 0xE007F) || // tags
+		unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r)
+}
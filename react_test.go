@@ -0,0 +1,37 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "testing"
+
+func TestIsSingleEmoji(t *testing.T) {
+	tests := []struct {
+		reaction string
+		want     bool
+	}{
+		{"⏳", true},
+		{"✅", true},
+		{"❤️", true},
+		{"👍🏽", true},
+		{"🇩🇪", true},
+		{"1️⃣", true},
+		{"👨‍👩‍👧", true},
+		{"🏴󠁧󠁢󠁳󠁣󠁴󠁿", true},
+		{"", false},
+		{"a", false},
+		{"á", false},
+		{"1", false},
+		{"ok", false},
+		{"👍👍", false},
+		{"👍 ", false},
+		{"👨‍", false},
+		{"🇩", false},
+	}
+	for _, test := range tests {
+		if got := isSingleEmoji(test.reaction); got != test.want {
+			t.Errorf("isSingleEmoji(%q) = %v, want %v", test.reaction, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// reconnectState tracks the outages of the connection to WhatsApp.
+var reconnectState struct {
+	mu             sync.Mutex
+	disconnectedAt time.Time
+	downtime       time.Duration
+}
+
+// reconnectEnabled reports whether the client is to reconnect after being disconnected rather than exit.
+func reconnectEnabled() bool {
+	return *reconnectMaxAttempts > 0 || *reconnectMaxDuration > 0
+}
+
+func onDisconnected() {
+	reconnectState.mu.Lock()
+	defer reconnectState.mu.Unlock()
+	if reconnectState.disconnectedAt.IsZero() {
+		reconnectState.disconnectedAt = time.Now()
+	}
+}
+
+func onReconnected() {
+	reconnectState.mu.Lock()
+	defer reconnectState.mu.Unlock()
+	if reconnectState.disconnectedAt.IsZero() {
+		return
+	}
+	outage := time.Since(reconnectState.disconnectedAt)
+	reconnectState.downtime += outage
+	reconnectState.disconnectedAt = time.Time{}
+	log.Infof("Reconnected after %s, %s of downtime in total.", outage.Round(time.Second), reconnectState.downtime.Round(time.Second))
+}
+
+// reconnectHook is called by the client after each failed attempt to reconnect.
+// Once the attempts or the outage exceed the limits, it gives up and has the program exit with an error.
+func reconnectHook(err error) bool {
+	reconnectState.mu.Lock()
+	defer reconnectState.mu.Unlock()
+	attempts := client().AutoReconnectErrors
+	outage := time.Since(reconnectState.disconnectedAt)
+	if (*reconnectMaxAttempts > 0 && attempts >= *reconnectMaxAttempts) || (*reconnectMaxDuration > 0 && outage >= *reconnectMaxDuration) {
+		log.Errorf("Giving up reconnecting after %d attempts and %s, %s of downtime in total.", attempts, outage.Round(time.Second), (reconnectState.downtime + outage).Round(time.Second))
+		quit(1)
+		return false
+	}
+	return true
+}
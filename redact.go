@@ -0,0 +1,45 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The following helpers are to be used whenever personal information is logged.
+// With -redact-pii, they mask it so logs do not contain phone numbers or names.
+
+// redactJID shows only the last four digits of the phone number (or other user part) of the JID.
+func redactJID(jid types.JID) string {
+	if !*redactPII {
+		return jid.String()
+	}
+	user := jid.User
+	if len(user) > 4 {
+		user = "…" + user[len(user)-4:]
+	}
+	return fmt.Sprintf("%s@%s", user, jid.Server)
+}
+
+// redactName replaces the name by a short hash, so log lines of the same person can still be correlated.
+func redactName(name string) string {
+	if !*redactPII || name == "" {
+		return name
+	}
+	hash := sha256.Sum256([]byte(name))
+	return "#" + hex.EncodeToString(hash[:4])
+}
+
+// redactSource is the redacted equivalent of MessageSource.SourceString.
+func redactSource(source types.MessageSource) string {
+	if source.Sender != source.Chat {
+		return fmt.Sprintf("%s in %s", redactJID(source.Sender), redactJID(source.Chat))
+	}
+	return redactJID(source.Chat)
+}
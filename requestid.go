@@ -0,0 +1,52 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+type requestIDKey struct{}
+
+type messageIDKey struct{}
+
+// newRequestID returns a short random ID to tell the log lines of concurrent transcriptions apart.
+func newRequestID() string {
+	id := make([]byte, 3)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the ID of the transcription the context belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFor returns a logger which marks the log lines with the request ID of the context.
+func loggerFor(ctx context.Context) waLog.Logger {
+	if id := requestID(ctx); id != "" {
+		return log.Sub(id)
+	}
+	return log
+}
+
+func withMessageID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, id)
+}
+
+// messageID returns the ID of the message being transcribed, if any.
+func messageID(ctx context.Context) string {
+	id, _ := ctx.Value(messageIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// commands maps voice messages transcribed on request to the message requesting it.
+var commands sync.Map
+
+// rememberCommand has the command deleted once the voice message it refers to has been replied to.
+// Commands for voice messages which are not transcribed (e.g. since they have been already) are forgotten after a while.
+func rememberCommand(voiceMessage *events.Message, command *events.Message) {
+	commands.Store(voiceMessage.Info.ID, command)
+	time.AfterFunc(commandRetention, func() { commands.CompareAndDelete(voiceMessage.Info.ID, command) })
+}
+
+const commandRetention = time.Hour
+
+// revokeCommand deletes the message which requested the transcript of the voice message, if any.
+// Messages of others can only be deleted by group admins.
+func revokeCommand(ctx context.Context, voiceMessage *events.Message) {
+	value, ok := commands.LoadAndDelete(voiceMessage.Info.ID)
+	if !ok {
+		return
+	}
+	command := value.(*events.Message)
+	sender := types.EmptyJID
+	if !command.Info.IsFromMe {
+		if !isGroupAdmin(ctx, command.Info.Chat) {
+			loggerFor(ctx).Infof("Not deleting message %s requesting the transcript, only group admins can delete messages of others.", command.Info.ID)
+			return
+		}
+		sender = command.Info.Sender.ToNonAD()
+	}
+	err := sendMessage(ctx, command.Info.Chat, client().BuildRevoke(command.Info.Chat, sender, command.Info.ID))
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to delete message %s requesting the transcript: %v", command.Info.ID, err)
+	}
+}
+
+// isGroupAdmin reports whether this account is an admin of the group.
+func isGroupAdmin(ctx context.Context, chat types.JID) bool {
+	info, err := client().GetGroupInfo(chat)
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to get info of group %s: %v", redactJID(chat), err)
+		return false
+	}
+	for _, participant := range info.Participants {
+		if participant.JID.User == client().Store.ID.User {
+			return participant.IsAdmin || participant.IsSuperAdmin
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// sendPacer spaces out outgoing messages evenly, so bursts of replies stay below the limits of WhatsApp.
+type sendPacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// pacer is nil in case outgoing messages are not paced.
+var pacer *sendPacer
+
+func newSendPacer(perMinute int) *sendPacer {
+	return &sendPacer{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// Wait blocks until the next message may be sent.
+func (p *sendPacer) Wait() {
+	p.mu.Lock()
+	now := time.Now()
+	slot := p.next
+	if slot.Before(now) {
+		slot = now
+	}
+	p.next = slot.Add(p.interval)
+	p.mu.Unlock()
+	time.Sleep(time.Until(slot))
+}
+
+// isTransientSendError reports whether sending a message which failed with err is worth retrying.
+// Timeouts, lost connections, rate limits and server errors are. Other errors returned by the server,
+// like an unknown recipient, are permanent.
+func isTransientSendError(err error) bool {
+	var disconnected *whatsmeow.DisconnectedError
+	if errors.Is(err, whatsmeow.ErrNotConnected) || errors.Is(err, whatsmeow.ErrMessageTimedOut) ||
+		errors.Is(err, whatsmeow.ErrIQTimedOut) || errors.As(err, &disconnected) {
+		return true
+	}
+	code := 0
+	var iqErr *whatsmeow.IQError
+	if errors.As(err, &iqErr) {
+		code = iqErr.Code
+	} else if errors.Is(err, whatsmeow.ErrServerReturnedError) {
+		// the code is only part of the message
+		fields := strings.Fields(err.Error())
+		code, _ = strconv.Atoi(fields[len(fields)-1])
+	}
+	return code == 429 || code >= 500
+}
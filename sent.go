@@ -0,0 +1,17 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+)
+
+// sentMessages remembers the IDs of the messages sent by this program, so they are never handled as input.
+// Other devices of the account echo them back as messages from this account.
+var sentMessages = newRecentIDs(time.Hour)
+
+// playedMessages remembers the IDs of the voice messages which have been played on another device of the account,
+// or by the recipient in case of a voice message sent by the account in a private chat.
+var playedMessages = newRecentIDs(24 * time.Hour)
@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// maxServeUpload limits the size of audio accepted by the transcription endpoint.
+const maxServeUpload = 25 << 20
+
+// serveTranscribe offers the transcription as HTTP endpoint. It runs until the program shuts down.
+// The audio is posted as request body or as "file" in a multipart form, the transcript is returned as JSON.
+func serveTranscribe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transcribe", handleTranscribeRequest)
+	mux.HandleFunc("/pause", handlePauseRequest(true))
+	mux.HandleFunc("/resume", handlePauseRequest(false))
+	mux.HandleFunc("/metrics", handleMetricsRequest)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-runCtx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	log.Infof("Serving transcriptions at http://%s/transcribe.", addr)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("Serving transcriptions failed: %v", err)
+	}
+}
+
+// isAuthorized checks the bearer token of the request, if a token is configured.
+func isAuthorized(r *http.Request) bool {
+	return *serveTranscribeToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+*serveTranscribeToken)) == 1
+}
+
+// handlePauseRequest pauses or resumes the transcription of voice messages received via WhatsApp.
+func handlePauseRequest(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		setPaused(pause, "requested via HTTP from "+r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Paused bool `json:"paused"`
+		}{pause})
+	}
+}
+
+// handleMetricsRequest reports the state of the queue in the text format of Prometheus.
+func handleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	if !isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, `# HELP whatsmeow_transcribe_queue_depth Voice messages waiting to be processed.
+# TYPE whatsmeow_transcribe_queue_depth gauge
+whatsmeow_transcribe_queue_depth %d
+# HELP whatsmeow_transcribe_rejected_total Voice messages rejected since the queue was full.
+# TYPE whatsmeow_transcribe_rejected_total counter
+whatsmeow_transcribe_rejected_total %d
+# HELP whatsmeow_transcribe_transcribed_total Voice messages transcribed successfully.
+# TYPE whatsmeow_transcribe_transcribed_total counter
+whatsmeow_transcribe_transcribed_total %d
+`, queue.Depth(), rejectedCount.Load(), transcribedCount.Load())
+	if breakers != nil {
+		fmt.Fprintf(w, "# HELP whatsmeow_transcribe_breaker_open Whether the backend is considered down.\n")
+		fmt.Fprintf(w, "# TYPE whatsmeow_transcribe_breaker_open gauge\n")
+		names := make([]string, 0, len(breakers))
+		for name := range breakers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			open := 0
+			if breakers[name].IsOpen() {
+				open = 1
+			}
+			fmt.Fprintf(w, "whatsmeow_transcribe_breaker_open{backend=%q} %d\n", name, open)
+		}
+	}
+}
+
+func handleTranscribeRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := withRequestID(r.Context(), newRequestID())
+	r.Body = http.MaxBytesReader(w, r.Body, maxServeUpload)
+	audio := Audio{Mimetype: r.Header.Get("Content-Type"), Language: r.URL.Query().Get("language")}
+	var err error
+	if file, header, formErr := r.FormFile("file"); formErr == nil {
+		defer file.Close()
+		audio.Mimetype = header.Header.Get("Content-Type")
+		audio.Data, err = io.ReadAll(file)
+	} else {
+		audio.Data, err = io.ReadAll(r.Body)
+	}
+	if err != nil || len(audio.Data) == 0 {
+		http.Error(w, "no audio", http.StatusBadRequest)
+		return
+	}
+	if budget != nil {
+		taken, err := budget.Acquire(ctx, int64(2*len(audio.Data)))
+		if err != nil {
+			return
+		}
+		defer budget.Release(taken)
+	}
+	audio = prepareAudio(ctx, audio)
+	start := time.Now()
+	transcript, err := transcribe(ctx, audio)
+	if err != nil {
+		loggerFor(ctx).Warnf("Transcription of uploaded audio failed: %v", err)
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, ErrRequest) || errors.Is(err, ErrUnsupported) {
+			status = http.StatusUnprocessableEntity
+		} else if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrRateLimited) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Text       string  `json:"text"`
+		Language   string  `json:"language,omitempty"`
+		Confidence float64 `json:"confidence,omitempty"`
+		Backend    string  `json:"backend"`
+		Retries    int     `json:"retries"`
+		LatencyMs  int64   `json:"latency_ms"`
+		RequestID  string  `json:"request_id"`
+	}{transcript.Text, transcript.Language, transcript.Confidence, transcript.Backend, transcript.Retries, time.Since(start).Milliseconds(), requestID(ctx)})
+}
@@ -0,0 +1,129 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// streamEditInterval is the minimum time between two edits of a partial reply.
+const streamEditInterval = 2 * time.Second
+
+// readEventStream reads the server-sent events of a streamed transcription.
+// partial is called with the transcript so far after each delta, if not nil.
+func readEventStream(body io.Reader, partial func(text string)) (Transcript, error) {
+	var text strings.Builder
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var event struct {
+			Type  string `json:"type"`
+			Delta string `json:"delta"`
+			Text  string `json:"text"`
+		}
+		err := json.Unmarshal([]byte(data), &event)
+		if err != nil {
+			return Transcript{}, fmt.Errorf("%w: unable to decode event: %v", ErrBackend, err)
+		}
+		switch event.Type {
+		case "transcript.text.delta":
+			text.WriteString(event.Delta)
+			if partial != nil {
+				partial(text.String())
+			}
+		case "transcript.text.done":
+			return Transcript{Text: event.Text}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Transcript{}, fmt.Errorf("%w: unable to read event stream: %v", ErrNetwork, err)
+	}
+	return Transcript{Text: text.String()}, nil
+}
+
+// partialReply is a reply which is sent while the transcript is still streaming in.
+// It is edited as more text arrives and once it is complete.
+type partialReply struct {
+	ctx  context.Context
+	evt  *events.Message
+	mu   sync.Mutex
+	id   types.MessageID
+	last time.Time
+}
+
+// Update sends or edits the reply with the transcript so far, at most every streamEditInterval.
+func (r *partialReply) Update(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.last) < streamEditInterval {
+		return
+	}
+	r.last = time.Now()
+	if annotations != nil {
+		text = stripAnnotations(text)
+	}
+	r.send(head(r.evt) + strings.TrimSpace(text) + " …")
+}
+
+// Finish edits the reply to contain the complete transcript.
+// It returns false in case no partial reply has been sent, so the transcript needs to be sent as usual.
+func (r *partialReply) Finish(text string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.id == "" {
+		return false
+	}
+	r.send(replyText(r.evt, text))
+	return true
+}
+
+// Discard deletes the partial reply, if one has been sent, since there is no transcript to complete it with.
+func (r *partialReply) Discard() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.id == "" {
+		return
+	}
+	err := sendMessage(r.ctx, r.evt.Info.Chat, client().BuildRevoke(r.evt.Info.Chat, types.EmptyJID, r.id))
+	if err != nil {
+		loggerFor(r.ctx).Warnf("Failed to delete partial transcript of message %s: %v", r.evt.Info.ID, err)
+	}
+	r.id = ""
+}
+
+func (r *partialReply) send(text string) {
+	msg := buildThreadedReply(r.evt, text)
+	if r.id == "" {
+		id, err := sendMessageID(r.ctx, r.evt.Info.Chat, msg)
+		if err != nil {
+			loggerFor(r.ctx).Warnf("Failed to send partial transcript of message %s: %v", r.evt.Info.ID, err)
+		}
+		r.id = id
+		return
+	}
+	err := sendMessage(r.ctx, r.evt.Info.Chat, client().BuildEdit(r.evt.Info.Chat, r.id, &waProto.Message{ExtendedTextMessage: msg.ExtendedTextMessage}))
+	if err != nil {
+		loggerFor(r.ctx).Warnf("Failed to update partial transcript of message %s: %v", r.evt.Info.ID, err)
+	}
+}
@@ -0,0 +1,77 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// audioRun is a number of consecutive voice messages by the same sender in a chat.
+type audioRun struct {
+	sender  types.JID
+	first   *events.Message
+	members []types.MessageID
+	closed  bool
+}
+
+var (
+	runsLock sync.Mutex
+	runs     = make(map[types.JID]*audioRun)
+	// runFirst maps the voice messages of the latest run in each chat to the first message of that run.
+	// They are kept until the next run starts, so transcripts still being processed find their thread.
+	runFirst = make(map[types.MessageID]*events.Message)
+)
+
+// trackRun updates the run of voice messages in the chat of the message.
+// Any other message in the chat ends the run. Reactions and protocol messages are not visible as such and are ignored.
+func trackRun(evt *events.Message) {
+	if *thread != "first" {
+		return
+	}
+	if evt.Message.GetReactionMessage() != nil || evt.Message.GetProtocolMessage() != nil {
+		return
+	}
+	runsLock.Lock()
+	defer runsLock.Unlock()
+	run := runs[evt.Info.Chat]
+	if len(findAudio(evt.Message)) == 0 {
+		if run != nil {
+			run.closed = true
+		}
+		return
+	}
+	if run == nil || run.closed || run.sender.ToNonAD() != evt.Info.Sender.ToNonAD() {
+		if run != nil {
+			for _, id := range run.members {
+				delete(runFirst, id)
+			}
+		}
+		run = &audioRun{sender: evt.Info.Sender, first: evt}
+		runs[evt.Info.Chat] = run
+	}
+	run.members = append(run.members, evt.Info.ID)
+	runFirst[evt.Info.ID] = run.first
+}
+
+// buildThreadedReply is buildReply for a transcript, threaded according to -thread.
+func buildThreadedReply(evt *events.Message, text string) *waProto.Message {
+	switch *thread {
+	case "none":
+		return &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(text)}}
+	case "first":
+		runsLock.Lock()
+		first := runFirst[evt.Info.ID]
+		runsLock.Unlock()
+		if first != nil {
+			return buildReply(first, text)
+		}
+	}
+	return buildReply(evt, text)
+}
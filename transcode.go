@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// optimizedArgs have ffmpeg produce 16 kHz mono opus, which is what Whisper works with internally.
+// 24 kbit/s is plenty for speech.
+var optimizedArgs = []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn", "-ac", "1", "-ar", "16000", "-c:a", "libopus", "-b:a", "24k", "-application", "voip", "-f", "ogg", "pipe:1"}
+
+// prepareAudio applies the configured processing to the audio before it is uploaded.
+func prepareAudio(ctx context.Context, audio Audio) Audio {
+	if *normalizeAudio {
+		// the normalized audio is encoded like the optimized one, so there is no need to optimize it as well
+		return normalize(ctx, audio)
+	}
+	if *optimizeUpload {
+		return optimizeAudio(ctx, audio)
+	}
+	return audio
+}
+
+// normalizedArgs have ffmpeg normalize the loudness (EBU R128) and encode the audio like optimizedArgs.
+// The filter prints its measurements on stderr as JSON.
+var normalizedArgs = []string{"-hide_banner", "-nostats", "-loglevel", "info", "-i", "pipe:0", "-vn", "-af", "loudnorm=I=-16:TP=-1.5:LRA=11:print_format=json", "-ac", "1", "-ar", "16000", "-c:a", "libopus", "-b:a", "24k", "-application", "voip", "-f", "ogg", "pipe:1"}
+
+var ffmpegMissing sync.Once
+
+// normalize raises the loudness of quiet audio (and lowers that of loud audio) to a common level,
+// which helps the accuracy of the transcription. The original audio is returned in case this fails.
+func normalize(ctx context.Context, audio Audio) Audio {
+	if _, err := exec.LookPath(*ffmpegPath); err != nil {
+		ffmpegMissing.Do(func() { loggerFor(ctx).Warnf("Cannot normalize audio without ffmpeg: %v", err) })
+		return audio
+	}
+	cmd := exec.CommandContext(ctx, *ffmpegPath, normalizedArgs...)
+	cmd.Stdin = bytes.NewReader(audio.Data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to normalize audio, using the original: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		return audio
+	}
+	var measured struct {
+		InputI  string `json:"input_i"`
+		OutputI string `json:"output_i"`
+	}
+	output := stderr.Bytes()
+	start, end := bytes.LastIndexByte(output, '{'), bytes.LastIndexByte(output, '}')
+	if start >= 0 && end > start && json.Unmarshal(output[start:end+1], &measured) == nil {
+		input, _ := strconv.ParseFloat(measured.InputI, 64)
+		normalized, _ := strconv.ParseFloat(measured.OutputI, 64)
+		loggerFor(ctx).Debugf("Normalized audio from %s to %s LUFS (%+.1f dB).", measured.InputI, measured.OutputI, normalized-input)
+	}
+	audio.Data = stdout.Bytes()
+	audio.Mimetype = "audio/ogg"
+	return audio
+}
+
+// optimizeAudio transcodes the audio to reduce the size of the upload.
+// The original audio is returned in case transcoding fails or does not make it smaller.
+func optimizeAudio(ctx context.Context, audio Audio) Audio {
+	optimized, err := transcodeAudio(ctx, audio.Data, optimizedArgs...)
+	if err != nil {
+		loggerFor(ctx).Warnf("Failed to optimize audio for upload, using the original: %v", err)
+		return audio
+	}
+	if len(optimized) >= len(audio.Data) {
+		loggerFor(ctx).Debugf("Optimizing audio for upload did not reduce its size (%d to %d bytes), using the original.", len(audio.Data), len(optimized))
+		return audio
+	}
+	loggerFor(ctx).Infof("Optimized audio for upload from %d to %d bytes (%.0f%% smaller).", len(audio.Data), len(optimized), 100-100*float64(len(optimized))/float64(len(audio.Data)))
+	audio.Data = optimized
+	audio.Mimetype = "audio/ogg"
+	return audio
+}
+
+// wavArgs have ffmpeg produce 16 kHz mono PCM, which any backend should be able to read.
+var wavArgs = []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn", "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", "-f", "wav", "pipe:1"}
+
+// convertToWav transcodes the audio for a backend which did not accept the original format.
+func convertToWav(ctx context.Context, audio Audio) (Audio, error) {
+	if _, err := exec.LookPath(*ffmpegPath); err != nil {
+		return audio, err
+	}
+	wav, err := transcodeAudio(ctx, audio.Data, wavArgs...)
+	if err != nil {
+		return audio, err
+	}
+	audio.Data = wav
+	audio.Mimetype = "audio/wav"
+	return audio, nil
+}
+
+func transcodeAudio(ctx context.Context, data []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, *ffmpegPath, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// probeDuration asks ffprobe for the duration of the audio in seconds.
+// Not all containers tell their duration when read from a pipe, so this may fail.
+func probeDuration(ctx context.Context, data []byte) (float64, error) {
+	cmd := exec.CommandContext(ctx, *ffprobePath, "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", "pipe:0")
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	seconds, err := strconv.ParseFloat(string(bytes.TrimSpace(stdout.Bytes())), 64)
+	if err != nil {
+		return 0, fmt.Errorf("no duration reported: %q", bytes.TrimSpace(stdout.Bytes()))
+	}
+	return seconds, nil
+}
@@ -0,0 +1,468 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Errors returned by a Transcriber. They are wrapped with details, use errors.Is to check.
+var (
+	ErrAuth        = errors.New("authentication failed")
+	ErrRateLimited = errors.New("rate limited")
+	ErrTooLarge    = errors.New("audio too large")
+	ErrRequest     = errors.New("request rejected")
+	ErrBackend     = errors.New("backend error")
+	ErrNetwork     = errors.New("network error")
+	ErrUnsupported = errors.New("unsupported audio format")
+)
+
+// Transcriber turns speech into text.
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio Audio) (Transcript, error)
+}
+
+// Audio is a recording to be transcribed.
+type Audio struct {
+	Data []byte
+	// Mimetype as announced by the sender, may be empty.
+	Mimetype string
+	// Temperature for sampling, zero for the backend default. Not all backends support this.
+	Temperature float64
+	// Language spoken in the audio, empty to have the backend detect it.
+	Language string
+	// Partial is called with the transcript so far by backends which stream their response, if not nil.
+	Partial func(text string)
+	// Backend to transcribe with, empty for the default.
+	Backend string
+}
+
+// Transcript is the result of a transcription.
+type Transcript struct {
+	Text string
+	// Language as detected by the backend, empty if unknown. The format depends on the backend.
+	Language string
+	// Confidence is an estimate of the probability of the transcript being right, zero if unknown.
+	Confidence float64
+	// Retries is the number of retries it took, this is not set by the backend.
+	Retries int
+	// Backend which produced the transcript, this is not set by the backend.
+	Backend string
+}
+
+// httpClient is used for all requests to the transcription backend.
+var httpClient = &http.Client{}
+
+// newHTTPClient creates a client for the transcription backend.
+// tlsMinVersion is the minimum TLS version to accept ("1.2", "1.3", …), empty for the Go default.
+func newHTTPClient(tlsMinVersion string) (*http.Client, error) {
+	if tlsMinVersion == "" {
+		return &http.Client{}, nil
+	}
+	versions := map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	version, ok := versions[tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", tlsMinVersion)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: version}
+	return &http.Client{Transport: transport}, nil
+}
+
+// newTranscriber creates the transcriber for the named backend as configured by the flags.
+func newTranscriber(backend string) (Transcriber, error) {
+	if *diarize && backend != "aws" {
+		return nil, fmt.Errorf("telling speakers apart is not supported by the %s backend, only by aws", backend)
+	}
+	if *diarize && (*maxSpeakers < 2 || *maxSpeakers > 30) {
+		return nil, fmt.Errorf("the maximum number of speakers must be between 2 and 30")
+	}
+	switch backend {
+	case "openai", "faster-whisper":
+		url, modelName := *apiUrl, *model
+		if backend == "faster-whisper" {
+			// a local server, usually without authentication
+			if !isFlagSet("api-url") {
+				url = "http://localhost:8000/v1/audio/transcriptions"
+			}
+			if modelName == "" {
+				modelName = "Systran/faster-whisper-small"
+			}
+		} else if modelName == "" {
+			modelName = "whisper-1"
+		}
+		key := newAPIKey(*apiKeyFlag)
+		if *apiKeyFile != "" {
+			value, err := readAPIKeyFile(*apiKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if value == "" {
+				return nil, fmt.Errorf("API key file %s is empty", *apiKeyFile)
+			}
+			key.Set(value)
+			err = watchAPIKeyFile(*apiKeyFile, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &OpenAITranscriber{
+			URL:          url,
+			Model:        modelName,
+			ModelField:   *modelField,
+			FileField:    *fileField,
+			Key:          key,
+			Organization: *openAIOrg,
+			Project:      *openAIProject,
+			Verbose:      *onlyLanguages != "" || *skipLanguages != "" || *lowConfidence > 0,
+			Stream:       *streamFlag,
+			StreamBody:   *streamMedia,
+			TextPath:     *responseTextPath,
+		}, nil
+	case "aws":
+		t, err := newAWSTranscribeTranscriber(*awsRegion, *awsBucket, *awsRole)
+		if err != nil {
+			return nil, err
+		}
+		t.Diarize = *diarize
+		t.MaxSpeakers = int32(*maxSpeakers)
+		return t, nil
+	case "vosk":
+		return newVoskTranscriber(*modelPath)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+}
+
+// defaultTimeout returns the time limit for one transcription with the named backend.
+// Local models may be a lot slower than the hosted API, Amazon Transcribe works asynchronously.
+func defaultTimeout(backend string) time.Duration {
+	switch backend {
+	case "faster-whisper":
+		return 10 * time.Minute
+	case "aws":
+		return 15 * time.Minute
+	case "vosk":
+		return 10 * time.Minute
+	default:
+		return 2 * time.Minute
+	}
+}
+
+// isTransient reports whether a transcription which failed with err is worth retrying.
+func isTransient(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrNetwork) || errors.Is(err, ErrBackend)
+}
+
+// classifyStatus maps a negative HTTP response status to one of the transcription errors.
+func classifyStatus(statusCode int) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrAuth
+	case statusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case statusCode == http.StatusRequestEntityTooLarge:
+		return ErrTooLarge
+	case statusCode >= 400 && statusCode < 500:
+		// the same request would be rejected again
+		return ErrRequest
+	default:
+		return ErrBackend
+	}
+}
+
+// unsupportedFormat matches the message of a backend which cannot decode the audio.
+var unsupportedFormat *regexp.Regexp
+
+// classifyResponse is classifyStatus, but also recognizes a complaint about the audio format in the response.
+func classifyResponse(statusCode int, responseText string) error {
+	if statusCode == http.StatusBadRequest && unsupportedFormat != nil && unsupportedFormat.MatchString(responseText) {
+		return ErrUnsupported
+	}
+	return classifyStatus(statusCode)
+}
+
+// OpenAITranscriber uses the OpenAI audio transcription API (or any compatible API).
+type OpenAITranscriber struct {
+	URL   string
+	Model string
+	// ModelField and FileField are the names of the form fields for the model and the audio.
+	ModelField   string
+	FileField    string
+	Key          *apiKey
+	Organization string
+	Project      string
+	// Verbose requests a verbose response which includes the detected language.
+	Verbose bool
+	// Stream requests the response as server-sent events. Streaming is not possible with Verbose.
+	Stream bool
+	// StreamBody sends the request while it is being written instead of assembling it in memory first.
+	StreamBody bool
+	// TextPath is the path of the transcript in a JSON response, empty for OpenAI's responses.
+	TextPath string
+	// streamUnsupported is set once the API rejected the stream parameter.
+	streamUnsupported atomic.Bool
+}
+
+// streamRejected matches the message of a backend which does not support streaming.
+var streamRejected = regexp.MustCompile(`(?i)\bstream(ing)?\b`)
+
+func (t *OpenAITranscriber) Transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	// in case a key is rejected, the other keys get a chance
+	for attempt := 1; ; attempt++ {
+		key := t.Key.Get()
+		transcript, err := t.transcribeWith(ctx, audio, key, t.Stream && !t.Verbose && !t.streamUnsupported.Load())
+		if !errors.Is(err, ErrAuth) || t.Key.Len() == 1 {
+			return transcript, err
+		}
+		t.Key.Failed(key)
+		if attempt >= t.Key.Len() {
+			return transcript, err
+		}
+		loggerFor(ctx).Warnf("Transcription: API key was rejected, trying the next one.")
+	}
+}
+
+func (t *OpenAITranscriber) transcribeWith(ctx context.Context, audio Audio, key string, stream bool) (Transcript, error) {
+	var body io.Reader
+	var contentType string
+	if t.StreamBody {
+		// the form is written while it is being sent, so the audio is not copied
+		reader, pipe := io.Pipe()
+		writer := multipart.NewWriter(pipe)
+		go func() {
+			pipe.CloseWithError(t.writeForm(writer, audio, stream))
+		}()
+		body, contentType = reader, writer.FormDataContentType()
+	} else {
+		buffer := &bytes.Buffer{}
+		writer := multipart.NewWriter(buffer)
+		err := t.writeForm(writer, audio, stream)
+		if err != nil {
+			return Transcript{}, err
+		}
+		body, contentType = buffer, writer.FormDataContentType()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", t.URL, body)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if key != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key))
+	}
+	if t.Organization != "" {
+		req.Header.Set("OpenAI-Organization", t.Organization)
+	}
+	if t.Project != "" {
+		req.Header.Set("OpenAI-Project", t.Project)
+	}
+
+	// Send the request
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: error sending request: %v", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	loggerFor(ctx).Infof("Transcription: Response status: %#v", resp.Status)
+
+	if *debugSaveResponses != "" {
+		var saved bytes.Buffer
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(resp.Body, &saved), resp.Body}
+		defer func() {
+			fields := t.formFields(audio, stream)
+			fields = append(fields, [2]string{t.FileField, fmt.Sprintf("%s (%s, %d bytes)", audioFileName(audio), audio.Mimetype, len(audio.Data))})
+			saveResponse(ctx, req, fields, resp, saved.Bytes())
+		}()
+	}
+
+	if stream && resp.StatusCode == http.StatusBadRequest {
+		// other reasons for rejecting the request are handled below
+		rejection, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return Transcript{}, fmt.Errorf("%w: unable to read response body: %v", ErrNetwork, err)
+		}
+		if streamRejected.Match(rejection) {
+			loggerFor(ctx).Warnf("Transcription: API does not support streaming, falling back to regular responses.")
+			t.streamUnsupported.Store(true)
+			return t.transcribeWith(ctx, audio, key, false)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(rejection))
+	}
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readEventStream(resp.Body, audio.Partial)
+	}
+
+	resposeBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: unable to read response body: %v", ErrNetwork, err)
+	}
+	responseText := string(resposeBody)
+	if settings().logUsage {
+		logUsageInfo(loggerFor(ctx), resp, resposeBody)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if !settings().logResponseBodies {
+			return Transcript{}, fmt.Errorf("%w: got negative response with status %d", classifyResponse(resp.StatusCode, responseText), resp.StatusCode)
+		}
+		return Transcript{}, fmt.Errorf("%w: got negative response with status %d: „%s“", classifyResponse(resp.StatusCode, responseText), resp.StatusCode, responseText)
+	}
+	if !t.Verbose && t.TextPath == "" {
+		return Transcript{Text: responseText}, nil
+	}
+	if !t.Verbose {
+		text, err := extractText(resposeBody, t.TextPath)
+		if err != nil {
+			return Transcript{}, fmt.Errorf("%w: %v", ErrBackend, err)
+		}
+		return Transcript{Text: text}, nil
+	}
+	var verbose struct {
+		Text     string `json:"text"`
+		Language string `json:"language"`
+		Segments []struct {
+			Start      float64 `json:"start"`
+			End        float64 `json:"end"`
+			AvgLogprob float64 `json:"avg_logprob"`
+		} `json:"segments"`
+	}
+	err = json.Unmarshal(resposeBody, &verbose)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: unable to decode response: %v", ErrBackend, err)
+	}
+	transcript := Transcript{Text: verbose.Text, Language: verbose.Language}
+	if t.TextPath != "" {
+		transcript.Text, err = extractText(resposeBody, t.TextPath)
+		if err != nil {
+			return Transcript{}, fmt.Errorf("%w: %v", ErrBackend, err)
+		}
+	}
+	// the average log probability of the tokens, weighted by the duration of the segments
+	var logprob, duration float64
+	for _, segment := range verbose.Segments {
+		logprob += segment.AvgLogprob * (segment.End - segment.Start)
+		duration += segment.End - segment.Start
+	}
+	if duration > 0 {
+		transcript.Confidence = math.Exp(logprob / duration)
+	}
+	return transcript, nil
+}
+
+// formFields returns the parameters of the request, in order and without the audio.
+func (t *OpenAITranscriber) formFields(audio Audio, stream bool) [][2]string {
+	fields := [][2]string{{t.ModelField, t.Model}}
+	if audio.Temperature > 0 {
+		fields = append(fields, [2]string{"temperature", strconv.FormatFloat(audio.Temperature, 'f', -1, 64)})
+	}
+	if stream {
+		fields = append(fields, [2]string{"stream", "true"})
+	}
+	if audio.Language != "" {
+		fields = append(fields, [2]string{"language", audio.Language})
+	}
+	if t.Verbose {
+		fields = append(fields, [2]string{"response_format", "verbose_json"})
+	} else if t.TextPath != "" {
+		fields = append(fields, [2]string{"response_format", "json"})
+	} else {
+		fields = append(fields, [2]string{"response_format", "text"})
+	}
+	return fields
+}
+
+// writeForm writes the fields of the request and the audio.
+func (t *OpenAITranscriber) writeForm(writer *multipart.Writer, audio Audio, stream bool) error {
+	for _, field := range t.formFields(audio, stream) {
+		writer.WriteField(field[0], field[1])
+	}
+	part, err := writer.CreateFormFile(t.FileField, audioFileName(audio))
+	if err != nil {
+		return fmt.Errorf("error creating form file: %w", err)
+	}
+	_, err = part.Write(audio.Data)
+	if err != nil {
+		return fmt.Errorf("error writing data into part: %w", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("error closing writer: %w", err)
+	}
+	return nil
+}
+
+func audioFileName(audio Audio) string {
+	return "ptt." + audioExtension(audio.Data, audio.Mimetype)
+}
+
+// extractText finds the transcript in a JSON response by a path like "results.transcripts[0].text".
+// A leading "$." is ignored, so simple JSONPath expressions work, too.
+func extractText(body []byte, path string) (string, error) {
+	var value any
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode response: %v", err)
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '.' || r == '[' || r == ']' }) {
+		switch node := value.(type) {
+		case map[string]any:
+			value = node[part]
+		case []any:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("response has no element %s in %s", part, path)
+			}
+			value = node[index]
+		default:
+			return "", fmt.Errorf("response has no %s in %s", part, path)
+		}
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("response has no text at %s", path)
+	}
+	return text, nil
+}
+
+// logUsageInfo logs the processing time and usage as reported by the API, where available.
+func logUsageInfo(l waLog.Logger, resp *http.Response, body []byte) {
+	if processingTime := resp.Header.Get("Openai-Processing-Ms"); processingTime != "" {
+		l.Infof("Transcription: API reports %s ms processing time.", processingTime)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var response struct {
+			Usage json.RawMessage `json:"usage"`
+		}
+		if json.Unmarshal(body, &response) == nil && len(response.Usage) > 0 {
+			l.Infof("Transcription: API reports usage %s.", response.Usage)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// filenamePlaceholders are the placeholders known in the file name template.
+var filenamePlaceholders = []string{"{date}", "{time}", "{chat}", "{sender}", "{id}"}
+
+var placeholderPattern = regexp.MustCompile(`\{[^}]*\}`)
+
+// unsafeFilenameChars are replaced in the values of the placeholders, so they cannot leave the directory.
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9@._+-]`)
+
+// validateFilenameTemplate checks the template for transcript files.
+// The message ID is required, or the files of different messages would overwrite each other.
+func validateFilenameTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		known := false
+		for _, name := range filenamePlaceholders {
+			known = known || placeholder == name
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder %s in the file name template, use %s", placeholder, strings.Join(filenamePlaceholders, ", "))
+		}
+	}
+	if !strings.Contains(template, "{id}") {
+		return fmt.Errorf("the file name template must contain {id}")
+	}
+	if filepath.IsAbs(template) || strings.Contains(template, "..") {
+		return fmt.Errorf("the file name template must be relative to the transcript directory")
+	}
+	return nil
+}
+
+// transcriptFilename returns the path of the transcript file of the message, relative to the transcript directory.
+func transcriptFilename(evt *events.Message) string {
+	sanitize := func(value string) string {
+		return unsafeFilenameChars.ReplaceAllString(value, "_")
+	}
+	timestamp := evt.Info.Timestamp.Local()
+	if evt.Info.Timestamp.IsZero() {
+		// e.g. a voice message transcribed since it has been quoted
+		timestamp = time.Now()
+	}
+	return strings.NewReplacer(
+		"{date}", timestamp.Format("2006-01-02"),
+		"{time}", timestamp.Format("150405"),
+		"{chat}", sanitize(evt.Info.Chat.String()),
+		"{sender}", sanitize(evt.Info.Sender.ToNonAD().String()),
+		"{id}", sanitize(evt.Info.ID),
+	).Replace(*transcriptFilenameTemplate)
+}
+
+// writeTranscriptFile archives the transcript as a text file in the transcript directory.
+func writeTranscriptFile(evt *events.Message, text string) {
+	path := filepath.Join(*transcriptDir, transcriptFilename(evt))
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.WriteFile(path, []byte(text+"\n"), 0600)
+	}
+	if err != nil {
+		log.Warnf("Failed to write transcript of message %s to %s: %v", evt.Info.ID, path, err)
+	}
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build vosk
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	vosk "github.com/alphacep/vosk-api/go"
+)
+
+// pcmArgs have ffmpeg produce raw 16 kHz mono 16 bit PCM, which is what Vosk takes.
+var pcmArgs = []string{"-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-vn", "-ac", "1", "-ar", "16000", "-f", "s16le", "pipe:1"}
+
+const voskSampleRate = 16000
+
+// VoskTranscriber runs a Vosk model in-process. The model is loaded once and shared by all transcriptions.
+type VoskTranscriber struct {
+	model *vosk.VoskModel
+}
+
+func newVoskTranscriber(modelPath string) (*VoskTranscriber, error) {
+	if modelPath == "" {
+		return nil, fmt.Errorf("the vosk backend needs the model directory given by -model-path")
+	}
+	vosk.SetLogLevel(-1)
+	model, err := vosk.NewModel(modelPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load vosk model from %s: %w", modelPath, err)
+	}
+	return &VoskTranscriber{model: model}, nil
+}
+
+type voskResult struct {
+	Text   string `json:"text"`
+	Result []struct {
+		Conf float64 `json:"conf"`
+	} `json:"result"`
+}
+
+func (t *VoskTranscriber) Transcribe(ctx context.Context, audio Audio) (Transcript, error) {
+	pcm, err := transcodeAudio(ctx, audio.Data, pcmArgs...)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: failed to decode audio for vosk: %v", ErrUnsupported, err)
+	}
+	recognizer, err := vosk.NewRecognizer(t.model, voskSampleRate)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+	defer recognizer.Free()
+	recognizer.SetWords(1)
+	// one second of audio per call, so a cancellation is noticed in time
+	const chunk = 2 * voskSampleRate
+	for len(pcm) > 0 {
+		if err := ctx.Err(); err != nil {
+			return Transcript{}, err
+		}
+		n := min(chunk, len(pcm))
+		recognizer.AcceptWaveform(pcm[:n])
+		pcm = pcm[n:]
+	}
+	var result voskResult
+	err = json.Unmarshal([]byte(recognizer.FinalResult()), &result)
+	if err != nil {
+		return Transcript{}, fmt.Errorf("%w: failed to parse vosk result: %v", ErrBackend, err)
+	}
+	transcript := Transcript{Text: result.Text}
+	if len(result.Result) > 0 {
+		sum := 0.0
+		for _, word := range result.Result {
+			sum += word.Conf
+		}
+		transcript.Confidence = sum / float64(len(result.Result))
+	}
+	return transcript, nil
+}
@@ -0,0 +1,16 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !vosk
+
+package main
+
+import (
+	"fmt"
+)
+
+// newVoskTranscriber is not available, the vosk backend needs cgo and the Vosk library.
+func newVoskTranscriber(modelPath string) (Transcriber, error) {
+	return nil, fmt.Errorf("this program was built without the vosk backend, build it with -tags vosk")
+}